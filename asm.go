@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Assemble turns a textual instruction listing into bytecode. A listing has
+// one instruction or directive per line:
+//
+//	; comments start with ';' or '#'
+//	.const greeting "hello"    named constant: number, "string", true, false, nil or @label
+//	.line 3                    source line for the instructions that follow
+//	loop:                      label, may also prefix an instruction
+//	CONSTANT greeting          constant by name, or an inline literal
+//	JUMP_IF_FALSE done         jumps and TRY take a label or an address
+//	MAKE_FUNC @square          funcptr to a label, or a named funcptr constant
+//	GET_LOCAL 0                slots and RESERVE counts are numbers
+//	CALL print                 names for globals, calls and methods
+func Assemble(source string) ([]Instruction, []Constant, error) {
+	type asmLine struct {
+		no     int
+		fields []string
+	}
+
+	var lines []asmLine
+	labels := make(map[string]int)
+	count := 0
+	for i, text := range strings.Split(source, "\n") {
+		fields, err := asmFields(text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		for len(fields) > 0 && strings.HasSuffix(fields[0], ":") && !strings.HasPrefix(fields[0], `"`) {
+			name := strings.TrimSuffix(fields[0], ":")
+			if _, ok := labels[name]; ok {
+				return nil, nil, fmt.Errorf("line %d: label %s defined twice", i+1, name)
+			}
+			labels[name] = count
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(fields[0], ".") {
+			count++
+		}
+		lines = append(lines, asmLine{no: i + 1, fields: fields})
+	}
+
+	a := &assembler{labels: labels, named: make(map[string]int)}
+	for _, l := range lines {
+		if err := a.assemble(l.fields); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", l.no, err)
+		}
+	}
+	return a.instructions, a.constants, nil
+}
+
+type assembler struct {
+	instructions []Instruction
+	constants    []Constant
+	labels       map[string]int
+	named        map[string]int
+	line         int
+}
+
+func (a *assembler) assemble(fields []string) error {
+	name := fields[0]
+	args := fields[1:]
+
+	switch name {
+	case ".const":
+		if len(args) != 2 {
+			return fmt.Errorf(".const expects a name and a value")
+		}
+		if _, ok := a.named[args[0]]; ok {
+			return fmt.Errorf("constant %s defined twice", args[0])
+		}
+		c, err := a.literal(args[1])
+		if err != nil {
+			return err
+		}
+		a.named[args[0]] = a.addConstant(c)
+		return nil
+	case ".line":
+		if len(args) != 1 {
+			return fmt.Errorf(".line expects a number")
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid line %s", args[0])
+		}
+		a.line = n
+		return nil
+	}
+
+	op, ok := opcodeByName(name)
+	if !ok {
+		return fmt.Errorf("unknown instruction %s", name)
+	}
+
+	var arg interface{}
+	switch op {
+	case OpCallNative, OpCallDirect:
+		return fmt.Errorf("%s: only the VM emits this when it links code, use CALL", op)
+	case OpConstant, OpMakeFunc, OpJump, OpJumpIfFalse, OpTry,
+		OpGetGlobal, OpSetGlobal, OpCall, OpTailCall, OpCallMethod,
+		OpGetLocal, OpSetLocal, OpReserve, OpArray:
+		if len(args) != 1 {
+			return fmt.Errorf("%s expects one argument", op)
+		}
+		var err error
+		if arg, err = a.argument(op, args[0]); err != nil {
+			return err
+		}
+	default:
+		if len(args) != 0 {
+			return fmt.Errorf("%s takes no argument", op)
+		}
+	}
+
+	a.instructions = append(a.instructions, Instruction{Op: op, Arg: arg, Line: a.line})
+	return nil
+}
+
+func (a *assembler) argument(op OpCode, text string) (interface{}, error) {
+	switch op {
+	case OpConstant, OpMakeFunc:
+		idx, ok := a.named[text]
+		if !ok {
+			c, err := a.literal(text)
+			if err != nil {
+				return nil, err
+			}
+			idx = a.addConstant(c)
+		}
+		if op == OpMakeFunc && a.constants[idx].Type != "funcptr" {
+			return nil, fmt.Errorf("MAKE_FUNC needs a funcptr, got %s", a.constants[idx].Type)
+		}
+		return float64(idx), nil
+	case OpJump, OpJumpIfFalse, OpTry:
+		if target, ok := a.labels[text]; ok {
+			return float64(target), nil
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, fmt.Errorf("unknown label %s", text)
+		}
+		return float64(n), nil
+	case OpGetLocal, OpSetLocal, OpReserve:
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s expects a slot number, got %s", op, text)
+		}
+		return float64(n), nil
+	case OpArray:
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ARRAY expects an element count, got %s", text)
+		}
+		return float64(n), nil
+	}
+	if strings.HasPrefix(text, `"`) {
+		return strconv.Unquote(text)
+	}
+	return text, nil
+}
+
+func (a *assembler) literal(text string) (Constant, error) {
+	switch {
+	case text == "nil":
+		return Constant{Value: nil, Type: "nil"}, nil
+	case text == "true" || text == "false":
+		return Constant{Value: text == "true", Type: "bool"}, nil
+	case strings.HasPrefix(text, `"`):
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return Constant{}, fmt.Errorf("invalid string %s", text)
+		}
+		return Constant{Value: s, Type: "string"}, nil
+	case strings.HasPrefix(text, "@"):
+		target, ok := a.labels[text[1:]]
+		if !ok {
+			return Constant{}, fmt.Errorf("unknown label %s", text[1:])
+		}
+		return Constant{Value: float64(target), Type: "funcptr"}, nil
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return Constant{}, fmt.Errorf("unknown constant %s", text)
+	}
+	return Constant{Value: n, Type: "number"}, nil
+}
+
+func (a *assembler) addConstant(c Constant) int {
+	a.constants = append(a.constants, c)
+	return len(a.constants) - 1
+}
+
+func opcodeByName(name string) (OpCode, bool) {
+	name = strings.ToUpper(name)
+	for op, opName := range opNames {
+		if opName == name {
+			return OpCode(op), true
+		}
+	}
+	return 0, false
+}
+
+// asmFields splits a listing line into fields, keeping quoted strings whole
+// and dropping comments.
+func asmFields(text string) ([]string, error) {
+	var fields []string
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			i++
+		case c == ';' || c == '#':
+			return fields, nil
+		case c == '"':
+			j := i + 1
+			for j < len(text) && text[j] != '"' {
+				if text[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(text) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			fields = append(fields, text[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t\r,;#\"", rune(text[j])) {
+				j++
+			}
+			fields = append(fields, text[i:j])
+			i = j
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"lightlang/builtins"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// largeProgram compiles a generated script of n assignments and if
+// statements, about a hundred bytes of bytecode each.
+func largeProgram(tb testing.TB, n int) *Image {
+	var src strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&src, "let v%d = %d * 2 + %d.5\n", i, i, i)
+		fmt.Fprintf(&src, "if v%d > %d then\n  print(\"value %d\")\nend\n", i, i, i)
+	}
+	instructions, constants, _, err := Compile(src.String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Image{Instructions: instructions, Constants: constants}
+}
+
+// encodeV3 writes img in the bit packed layout of version 3.0, the way the
+// compiler did before version 4.
+func encodeV3(img *Image) []byte {
+	var buf bytes.Buffer
+	w := NewBitWriter(&buf)
+	putString := func(s string) {
+		for _, ch := range []byte(s) {
+			w.WriteBits(uint64(ch), 8)
+		}
+	}
+	w.WriteUint32(MagicHeader)
+	w.WriteUint8(3 << 4)
+	w.WriteVarUint(uint32(len(img.Constants)))
+	w.WriteVarUint(uint32(len(img.Instructions)))
+
+	for _, c := range img.Constants {
+		switch c.Type {
+		case "number":
+			w.WriteBits(ConstTypeNumber, 3)
+			if val, ok := c.Value.(int); ok && val >= -64 && val <= 63 {
+				w.WriteBits(1, 1)
+				w.WriteBits(uint64(int8(val))&0x7F, 7)
+				continue
+			}
+			w.WriteBits(0, 1)
+			w.WriteBits(math.Float64bits(toFloat64(c.Value)), 64)
+		case "string":
+			str := c.Value.(string)
+			w.WriteBits(ConstTypeString, 3)
+			if len(str) <= 255 {
+				w.WriteBits(1, 1)
+				w.WriteBits(uint64(len(str)), 8)
+			} else {
+				w.WriteBits(0, 1)
+				w.WriteVarUint(uint32(len(str)))
+			}
+			putString(str)
+		case "funcptr":
+			w.WriteBits(ConstTypeFuncPtr, 3)
+			w.WriteVarUint(uint32(toFloat64(c.Value)))
+		case "bool":
+			w.WriteBits(ConstTypeBool, 3)
+			if c.Value == true {
+				w.WriteBits(1, 1)
+			} else {
+				w.WriteBits(0, 1)
+			}
+		case "nil":
+			w.WriteBits(ConstTypeNil, 3)
+		}
+	}
+
+	for _, inst := range img.Instructions {
+		opcode := uint64(inst.Op) & 0x7F
+		if inst.Arg != nil {
+			opcode |= 0x80
+		}
+		w.WriteBits(opcode, 8)
+		w.WriteVarUint16(uint16(inst.Line))
+		switch arg := inst.Arg.(type) {
+		case float64:
+			if arg == float64(int32(arg)) {
+				w.WriteBits(ArgTypeInt, 2)
+				w.WriteVarInt(int32(arg))
+			} else {
+				w.WriteBits(ArgTypeFloat, 2)
+				w.WriteBits(math.Float64bits(arg), 64)
+			}
+		case int:
+			w.WriteBits(ArgTypeInt, 2)
+			w.WriteVarInt(int32(arg))
+		case string:
+			w.WriteBits(ArgTypeString, 2)
+			w.WriteVarUint(uint32(len(arg)))
+			putString(arg)
+		}
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// encodeV3 has to write what the version 3 compiler did for the benchmarks
+// to compare the formats fairly.
+func TestEncodeV3MatchesCompiler(t *testing.T) {
+	want, err := os.ReadFile("tests/v3/functions.llbytecode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := NewBytecodeReader(bytes.NewReader(want)).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := encodeV3(img); !bytes.Equal(got, want) {
+		t.Errorf("encodeV3 wrote %d bytes that differ from the compiler's %d", len(got), len(want))
+	}
+}
+
+// BenchmarkDecode loads a program of a few megabytes stored bit packed, as
+// version 3 wrote it, and byte aligned, as version 4 does.
+func BenchmarkDecode(b *testing.B) {
+	img := largeProgram(b, 30000)
+	var v4 bytes.Buffer
+	if err := NewBytecodeWriter(&v4).Write(img); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, format := range []struct {
+		name string
+		data []byte
+	}{{"v3", encodeV3(img)}, {"v4", v4.Bytes()}} {
+		b.Run(format.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(format.data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := NewBytecodeReader(bytes.NewReader(format.data)).Read(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	img := largeProgram(b, 30000)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := NewBytecodeWriter(&buf).Write(img); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(buf.Len()))
+}
+
+// loopScript is number-heavy code, which shouldn't allocate per iteration.
+const loopScript = `func sum(n)
+  let total = 0
+  let i = 0
+  while i < n do
+    total = total + i * 2
+    i = i + 1
+  end
+  return total
+end
+let result = sum(100000)
+`
+
+// BenchmarkRun runs loopScript, leaving compiling and optimizing out of the
+// time and allocations.
+func BenchmarkRun(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		instructions, constants, symbols, err := Compile(loopScript)
+		if err != nil {
+			b.Fatal(err)
+		}
+		vm := NewVM()
+		vm.Instructions, vm.Constants = OptimizeBytecode(instructions, constants, symbols)
+		b.StartTimer()
+		if err := vm.Run(""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkKeyCache compares a table site converting the same number key
+// through its keyCache with formatting the key every time, which is what the
+// site did before it kept the last conversion.
+func BenchmarkKeyCache(b *testing.B) {
+	index := builtins.Number(42)
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		var keys keyCache
+		for i := 0; i < b.N; i++ {
+			keys.lookup(index)
+		}
+	})
+	b.Run("formatted", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = index.String()
+		}
+	})
+}
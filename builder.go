@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 type OpCode byte
 
 const (
@@ -32,8 +34,65 @@ const (
 	OpGetIndex
 	OpNot
 	OpHalt
+	OpCallMethod
+	OpReserve
+	OpTry
+	OpEndTry
+	OpThrow
+	OpImport
+	OpCallNative
+	OpCallDirect
+	OpTailCall
 )
 
+var opNames = [...]string{
+	OpConstant:     "CONSTANT",
+	OpAdd:          "ADD",
+	OpSub:          "SUB",
+	OpMul:          "MUL",
+	OpDiv:          "DIV",
+	OpCmpEq:        "CMP_EQ",
+	OpCmpNe:        "CMP_NE",
+	OpCmpLt:        "CMP_LT",
+	OpCmpLte:       "CMP_LTE",
+	OpCmpGt:        "CMP_GT",
+	OpCmpGte:       "CMP_GTE",
+	OpPop:          "POP",
+	OpSetGlobal:    "SET_GLOBAL",
+	OpGetGlobal:    "GET_GLOBAL",
+	OpSetLocal:     "SET_LOCAL",
+	OpGetLocal:     "GET_LOCAL",
+	OpMakeFunc:     "MAKE_FUNC",
+	OpCall:         "CALL",
+	OpCallIndirect: "CALL_INDIRECT",
+	OpReturn:       "RETURN",
+	OpNop:          "NOP",
+	OpJump:         "JUMP",
+	OpJumpIfFalse:  "JUMP_IF_FALSE",
+	OpTable:        "TABLE",
+	OpArray:        "ARRAY",
+	OpSetIndex:     "SET_INDEX",
+	OpGetIndex:     "GET_INDEX",
+	OpNot:          "NOT",
+	OpHalt:         "HALT",
+	OpCallMethod:   "CALL_METHOD",
+	OpReserve:      "RESERVE",
+	OpTry:          "TRY",
+	OpEndTry:       "END_TRY",
+	OpThrow:        "THROW",
+	OpImport:       "IMPORT",
+	OpCallNative:   "CALL_NATIVE",
+	OpCallDirect:   "CALL_DIRECT",
+	OpTailCall:     "TAIL_CALL",
+}
+
+func (op OpCode) String() string {
+	if int(op) < len(opNames) && opNames[op] != "" {
+		return opNames[op]
+	}
+	return fmt.Sprintf("OP_%d", byte(op))
+}
+
 type Instruction struct {
 	Op   OpCode
 	Arg  interface{}
@@ -59,6 +118,7 @@ type SymbolTable struct {
 	Parent    *SymbolTable
 	Locals    map[string]int
 	Globals   map[string]string
+	Exports   map[string]bool
 	IsFunc    bool
 	NextLocal int
 }
@@ -68,6 +128,7 @@ func NewSymbolTable(parent *SymbolTable, isFunc bool) *SymbolTable {
 		Parent:    parent,
 		Locals:    make(map[string]int, 8),
 		Globals:   make(map[string]string, 4),
+		Exports:   make(map[string]bool),
 		IsFunc:    isFunc,
 		NextLocal: 0,
 	}
@@ -131,6 +192,11 @@ type CallNode struct {
 	CallType       string
 	IndirectTarget Node
 }
+type MethodCallNode struct {
+	Receiver Node
+	Method   string
+	Args     []Node
+}
 type TableLiteralNode struct {
 	Keys    []string
 	Values  []Node
@@ -153,11 +219,32 @@ type FuncDefNode struct {
 	Name   string
 	Params []string
 	Body   []Node
+	Owner  Node
 }
 type AnonymousFuncNode struct {
 	Params []string
 	Body   []Node
 }
+type ClassNode struct {
+	Name    string
+	Base    Node
+	Methods []*FuncDefNode
+}
+type TryNode struct {
+	Body        []Node
+	CatchVar    string
+	CatchBody   []Node
+	HasCatch    bool
+	FinallyBody []Node
+}
+type ExportNode struct {
+	Decl Node
+	Name string
+}
+
+// LineNode marks where a statement starts in the source. It emits nothing
+// but tags the following instructions with the line.
+type LineNode struct{ Line int }
 type ReturnNode struct{ Value Node }
 type BreakNode struct{}
 
@@ -166,6 +253,22 @@ type Builder struct {
 	Constants    []Constant
 	SymbolTable  *SymbolTable
 	LoopStack    []int
+	Classes      map[string]*ClassNode
+	Class        *ClassNode
+	Line         int
+	// Tries are the try statements around the code being emitted in the
+	// current function, innermost last. A call inside one is never a tail
+	// call, since the try has to see its errors, and a return leaving one
+	// has to run its finally code first.
+	Tries []*tryScope
+}
+
+// tryScope is a try statement being emitted. open tells whether its handler
+// is active at this point and finally is the code still to run on the way
+// out, nil once the finally code itself is being emitted.
+type tryScope struct {
+	open    bool
+	finally []Node
 }
 
 func NewBuilder() *Builder {
@@ -174,6 +277,7 @@ func NewBuilder() *Builder {
 		Constants:    make([]Constant, 0, 16),
 		SymbolTable:  NewSymbolTable(nil, false),
 		LoopStack:    make([]int, 0, 4),
+		Classes:      make(map[string]*ClassNode),
 	}
 }
 
@@ -183,7 +287,7 @@ func (b *Builder) AddConstant(val interface{}, typ string) int {
 }
 
 func (b *Builder) Emit(op OpCode, arg interface{}) {
-	b.Instructions = append(b.Instructions, Instruction{Op: op, Arg: arg, Line: 0})
+	b.Instructions = append(b.Instructions, Instruction{Op: op, Arg: arg, Line: b.Line})
 }
 
 func (b *Builder) UpdateInstruction(idx int, arg interface{}) {
@@ -304,7 +408,6 @@ func (n *ForLoopNode) emitUpdateOrInit(b *Builder, node Node) {
 		} else {
 			b.Emit(OpSetGlobal, assign.Name)
 		}
-		b.Emit(OpPop, nil)
 	} else {
 		node.Emit(b)
 		b.Emit(OpPop, nil)
@@ -435,6 +538,7 @@ func (n *IndexAssignNode) Emit(b *Builder) {
 	n.Index.Emit(b)
 	n.Value.Emit(b)
 	b.Emit(OpSetIndex, nil)
+	b.Emit(OpPop, nil)
 }
 
 func (n *IndexAccessNode) TypeCheck(sym *SymbolTable) error { return nil }
@@ -460,6 +564,20 @@ func (n *CallNode) TypeCheck(sym *SymbolTable) error {
 }
 
 func (n *CallNode) Emit(b *Builder) {
+	if n.CallType == "direct" && n.Target == "require" && len(n.Args) == 1 {
+		n.Args[0].Emit(b)
+		b.Emit(OpImport, nil)
+		return
+	}
+	if n.CallType == "direct" && n.Target == "super" && b.emitSuperCall("constructor", n.Args) {
+		return
+	}
+	if access, ok := n.IndirectTarget.(*IndexAccessNode); ok && isSuper(access.Table) {
+		if key, ok := access.Index.(*LiteralNode); ok && key.Type == "string" && b.emitSuperCall(key.Value.(string), n.Args) {
+			return
+		}
+	}
+
 	for _, arg := range n.Args {
 		arg.Emit(b)
 	}
@@ -474,6 +592,30 @@ func (n *CallNode) Emit(b *Builder) {
 	}
 }
 
+func (n *MethodCallNode) TypeCheck(sym *SymbolTable) error {
+	if err := n.Receiver.TypeCheck(sym); err != nil {
+		return err
+	}
+	for _, arg := range n.Args {
+		if err := arg.TypeCheck(sym); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *MethodCallNode) Emit(b *Builder) {
+	if isSuper(n.Receiver) && b.emitSuperCall(n.Method, n.Args) {
+		return
+	}
+	n.Receiver.Emit(b)
+	for _, arg := range n.Args {
+		arg.Emit(b)
+	}
+	b.Emit(OpConstant, float64(b.AddConstant(float64(len(n.Args)), "number")))
+	b.Emit(OpCallMethod, n.Method)
+}
+
 func (n *TableLiteralNode) TypeCheck(sym *SymbolTable) error { return nil }
 func (n *TableLiteralNode) Emit(b *Builder) {
 	if n.IsArray {
@@ -571,6 +713,9 @@ func (n *IfNode) Emit(b *Builder) {
 }
 
 func (n *FuncDefNode) TypeCheck(sym *SymbolTable) error {
+	if n.Owner != nil {
+		return n.Owner.TypeCheck(sym)
+	}
 	sym.Define(n.Name, false)
 	return nil
 }
@@ -579,14 +724,15 @@ func (n *FuncDefNode) Emit(b *Builder) {
 	b.Emit(OpJump, 0)
 	funcJumpIdx := len(b.Instructions) - 1
 
-	prevSym := b.SymbolTable
-	b.SymbolTable = NewSymbolTable(prevSym, true)
+	prevSym, prevLine, prevTries := b.SymbolTable, b.Line, b.Tries
+	b.SymbolTable, b.Tries = NewSymbolTable(prevSym, true), nil
 
 	for _, param := range n.Params {
 		b.SymbolTable.Define(param, true)
 	}
 
 	startIp := len(b.Instructions)
+	b.Emit(OpReserve, 0)
 
 	for _, stmt := range n.Body {
 		stmt.Emit(b)
@@ -597,10 +743,19 @@ func (n *FuncDefNode) Emit(b *Builder) {
 		b.Emit(OpReturn, nil)
 	}
 
-	b.SymbolTable = prevSym
+	b.UpdateInstruction(startIp, float64(b.SymbolTable.NextLocal))
+	b.SymbolTable, b.Line, b.Tries = prevSym, prevLine, prevTries
 	b.UpdateInstruction(funcJumpIdx, len(b.Instructions))
 
 	idx := b.AddConstant(float64(startIp), "funcptr")
+	if n.Owner != nil {
+		n.Owner.Emit(b)
+		b.Emit(OpConstant, float64(b.AddConstant(n.Name, "string")))
+		b.Emit(OpMakeFunc, float64(idx))
+		b.Emit(OpSetIndex, nil)
+		b.Emit(OpPop, nil)
+		return
+	}
 	b.Emit(OpMakeFunc, float64(idx))
 	b.Emit(OpSetGlobal, n.Name)
 }
@@ -613,14 +768,56 @@ func (n *ReturnNode) TypeCheck(sym *SymbolTable) error {
 }
 
 func (n *ReturnNode) Emit(b *Builder) {
-	if n.Value != nil {
+	if call, ok := n.Value.(*CallNode); ok && b.tailCall(call) {
+		for _, arg := range call.Args {
+			arg.Emit(b)
+		}
+		b.Emit(OpConstant, float64(b.AddConstant(float64(len(call.Args)), "number")))
+		b.Emit(OpTailCall, call.Target)
+	} else if n.Value != nil {
 		n.Value.Emit(b)
 	} else {
 		b.Emit(OpConstant, float64(b.AddConstant(nil, "nil")))
 	}
+	b.leaveTries()
 	b.Emit(OpReturn, nil)
 }
 
+// leaveTries emits what a return does before leaving the try statements it
+// is in: innermost first, each open handler is closed and each finally body
+// runs. The value being returned waits on the stack underneath.
+func (b *Builder) leaveTries() {
+	tries := b.Tries
+	outer := 0
+	for outer < len(tries) && tries[outer].finally == nil {
+		outer++
+	}
+	for i := len(tries) - 1; i >= outer; i-- {
+		if tries[i].open {
+			b.Emit(OpEndTry, nil)
+		}
+		if tries[i].finally != nil {
+			b.Tries = tries[:i:i]
+			for _, stmt := range tries[i].finally {
+				stmt.Emit(b)
+			}
+		}
+	}
+	b.Tries = tries
+}
+
+// tailCall reports whether `return call` may reuse the caller's frame: a call
+// by name from inside a function and outside any try statement. require and
+// super aren't calls by name, CallNode.Emit compiles them itself. The RETURN
+// after TAIL_CALL still runs when the VM can't reuse the frame, say for a
+// builtin or a table with __call.
+func (b *Builder) tailCall(call *CallNode) bool {
+	if call.CallType != "direct" || call.Target == "require" || call.Target == "super" {
+		return false
+	}
+	return b.SymbolTable.IsFunc && len(b.Tries) == 0
+}
+
 func (n *BreakNode) TypeCheck(sym *SymbolTable) error { return nil }
 func (n *BreakNode) Emit(b *Builder) {
 	b.Emit(OpJump, -1)
@@ -634,14 +831,15 @@ func (n *AnonymousFuncNode) Emit(b *Builder) {
 	b.Emit(OpJump, 0)
 	funcJumpIdx := len(b.Instructions) - 1
 
-	prevSym := b.SymbolTable
-	b.SymbolTable = NewSymbolTable(prevSym, true)
+	prevSym, prevLine, prevTries := b.SymbolTable, b.Line, b.Tries
+	b.SymbolTable, b.Tries = NewSymbolTable(prevSym, true), nil
 
 	for _, param := range n.Params {
 		b.SymbolTable.Define(param, true)
 	}
 
 	startIp := len(b.Instructions)
+	b.Emit(OpReserve, 0)
 
 	for _, stmt := range n.Body {
 		stmt.Emit(b)
@@ -652,9 +850,196 @@ func (n *AnonymousFuncNode) Emit(b *Builder) {
 		b.Emit(OpReturn, nil)
 	}
 
-	b.SymbolTable = prevSym
+	b.UpdateInstruction(startIp, float64(b.SymbolTable.NextLocal))
+	b.SymbolTable, b.Line, b.Tries = prevSym, prevLine, prevTries
 	b.UpdateInstruction(funcJumpIdx, len(b.Instructions))
 
 	idx := b.AddConstant(float64(startIp), "funcptr")
 	b.Emit(OpMakeFunc, float64(idx))
 }
+
+func (n *ClassNode) TypeCheck(sym *SymbolTable) error {
+	sym.Define(n.Name, false)
+	if n.Base != nil {
+		return n.Base.TypeCheck(sym)
+	}
+	return nil
+}
+
+func (n *ClassNode) Emit(b *Builder) {
+	self := &VariableNode{Name: n.Name}
+	var classTable Node = &TableLiteralNode{}
+	if n.Base != nil {
+		classTable = &CallNode{Target: "setmetatable", Args: []Node{classTable, n.Base}, CallType: "direct"}
+	}
+	(&AssignmentNode{Name: n.Name, Expr: classTable}).Emit(b)
+	(&IndexAssignNode{Table: self, Index: &LiteralNode{Value: "__index", Type: "string"}, Value: self}).Emit(b)
+
+	prevClass := b.Class
+	b.Class = n
+	for _, method := range n.Methods {
+		method.Emit(b)
+	}
+	b.Class = prevClass
+	b.Classes[n.Name] = n
+
+	// new(params) creates the instance and runs the constructor on it. The
+	// constructor is looked up through __index so inherited ones are found.
+	params := n.constructorParams(b)
+	args := []Node{&VariableNode{Name: "self"}}
+	for _, param := range params {
+		args = append(args, &VariableNode{Name: param})
+	}
+	constructor := &IndexAccessNode{Table: self, Index: &LiteralNode{Value: "constructor", Type: "string"}}
+	factory := &FuncDefNode{
+		Name:   "new",
+		Params: params,
+		Owner:  self,
+		Body: []Node{
+			&AssignmentNode{
+				Name:    "self",
+				Expr:    &CallNode{Target: "setmetatable", Args: []Node{&TableLiteralNode{}, self}, CallType: "direct"},
+				IsLocal: true,
+			},
+			&IfNode{
+				Conditions: []Node{constructor},
+				Bodies: [][]Node{{&ExprStmtNode{Expr: &CallNode{
+					Args:           args,
+					CallType:       "indirect",
+					IndirectTarget: constructor,
+				}}}},
+			},
+			&ReturnNode{Value: &VariableNode{Name: "self"}},
+		},
+	}
+	factory.Emit(b)
+}
+
+// constructorParams returns the parameters of the class constructor, falling
+// back to the nearest base class compiled by this builder.
+func (n *ClassNode) constructorParams(b *Builder) []string {
+	for class := n; class != nil; {
+		for _, method := range class.Methods {
+			if method.Name == "constructor" {
+				return method.Params[1:]
+			}
+		}
+		base, ok := class.Base.(*VariableNode)
+		if !ok {
+			break
+		}
+		class = b.Classes[base.Name]
+	}
+	return nil
+}
+
+func isSuper(node Node) bool {
+	v, ok := node.(*VariableNode)
+	return ok && v.Name == "super"
+}
+
+func (b *Builder) emitSuperCall(method string, args []Node) bool {
+	if b.Class == nil || b.Class.Base == nil {
+		return false
+	}
+	(&CallNode{
+		Args:           append([]Node{&VariableNode{Name: "self"}}, args...),
+		CallType:       "indirect",
+		IndirectTarget: &IndexAccessNode{Table: b.Class.Base, Index: &LiteralNode{Value: method, Type: "string"}},
+	}).Emit(b)
+	return true
+}
+
+func (n *TryNode) TypeCheck(sym *SymbolTable) error {
+	for _, body := range [][]Node{n.Body, n.CatchBody, n.FinallyBody} {
+		for _, stmt := range body {
+			if err := stmt.TypeCheck(sym); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Emit lays the block out as body, catch handler, then two copies of the
+// finally body: one that rethrows the pending error and one for the normal
+// path.
+func (n *TryNode) Emit(b *Builder) {
+	hasFinally := n.FinallyBody != nil
+	scope := &tryScope{open: true, finally: n.FinallyBody}
+	b.Tries = append(b.Tries, scope)
+
+	tryIdx := len(b.Instructions)
+	b.Emit(OpTry, 0)
+	for _, stmt := range n.Body {
+		stmt.Emit(b)
+	}
+	b.Emit(OpEndTry, nil)
+	var endJumps []int
+	endJumps = append(endJumps, len(b.Instructions))
+	b.Emit(OpJump, 0)
+
+	b.UpdateInstruction(tryIdx, len(b.Instructions))
+	scope.open = false
+	rethrowIdx := -1
+	if n.HasCatch {
+		if n.CatchVar == "" {
+			b.Emit(OpPop, nil)
+		} else if b.SymbolTable.IsFunc {
+			b.Emit(OpSetLocal, float64(b.SymbolTable.Define(n.CatchVar, true)))
+		} else {
+			b.Emit(OpSetGlobal, n.CatchVar)
+		}
+		if hasFinally {
+			rethrowIdx = len(b.Instructions)
+			b.Emit(OpTry, 0)
+			scope.open = true
+		}
+		for _, stmt := range n.CatchBody {
+			stmt.Emit(b)
+		}
+		if hasFinally {
+			b.Emit(OpEndTry, nil)
+			scope.open = false
+		}
+		endJumps = append(endJumps, len(b.Instructions))
+		b.Emit(OpJump, 0)
+	}
+
+	scope.finally = nil
+	if hasFinally {
+		if rethrowIdx >= 0 {
+			b.UpdateInstruction(rethrowIdx, len(b.Instructions))
+		}
+		for _, stmt := range n.FinallyBody {
+			stmt.Emit(b)
+		}
+		b.Emit(OpThrow, nil)
+	}
+
+	finallyIdx := len(b.Instructions)
+	for _, idx := range endJumps {
+		b.UpdateInstruction(idx, finallyIdx)
+	}
+	for _, stmt := range n.FinallyBody {
+		stmt.Emit(b)
+	}
+	b.Tries = b.Tries[:len(b.Tries)-1]
+}
+
+func (n *ExportNode) TypeCheck(sym *SymbolTable) error {
+	sym.Exports[n.Name] = true
+	if n.Decl != nil {
+		return n.Decl.TypeCheck(sym)
+	}
+	return nil
+}
+
+func (n *ExportNode) Emit(b *Builder) {
+	if n.Decl != nil {
+		n.Decl.Emit(b)
+	}
+}
+
+func (n *LineNode) TypeCheck(sym *SymbolTable) error { return nil }
+func (n *LineNode) Emit(b *Builder)                  { b.Line = n.Line }
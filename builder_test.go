@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+// `return require(...)` imports the module, it isn't a tail call to a
+// function named require.
+func TestReturnRequire(t *testing.T) {
+	source := `func load(name)
+  return require(name)
+end
+print(load("lib/shapes").square(3):area())
+`
+	plain, optimized, err := runBoth(source, "tests/main.ll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "9\n"; plain != want || optimized != want {
+		t.Errorf("printed %q, optimized %q, want %q", plain, optimized, want)
+	}
+}
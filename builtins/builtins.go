@@ -3,6 +3,7 @@ package builtins
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
@@ -12,92 +13,153 @@ import (
 	"time"
 )
 
-type BuiltinFunc func(args []interface{}) (interface{}, error)
+type BuiltinFunc func(args []Value) (Value, error)
 
-func toFloat64(val interface{}) float64 {
-	if v, ok := val.(float64); ok {
-		return v
-	}
-	if v, ok := val.(int); ok {
-		return float64(v)
+// Output is where print writes.
+var Output io.Writer = os.Stdout
+
+// ScriptError carries a value thrown by a script, either through error() or
+// by rethrowing from a finally block.
+type ScriptError struct {
+	Value Value
+}
+
+func (e *ScriptError) Error() string {
+	if s, err := ToString(e.Value); err == nil {
+		return s
 	}
-	if v, ok := val.(int64); ok {
-		return float64(v)
+	return e.Value.String()
+}
+
+// ErrorValue returns the script-visible value of an error raised while running.
+func ErrorValue(err error) Value {
+	if se, ok := err.(*ScriptError); ok {
+		return se.Value
 	}
-	if v, ok := val.(int32); ok {
-		return float64(v)
+	return String(err.Error())
+}
+
+// numbers reads args as numbers, failing with "<name> requires numbers".
+func numbers(name string, args []Value) ([]float64, error) {
+	nums := make([]float64, len(args))
+	for i, arg := range args {
+		f, ok := arg.Num()
+		if !ok {
+			return nil, fmt.Errorf("%s requires numbers", name)
+		}
+		nums[i] = f
 	}
-	return 0.0
+	return nums, nil
 }
 
 var Builtins = map[string]BuiltinFunc{
-	"print": func(args []interface{}) (interface{}, error) {
-		fmt.Print(fmt.Sprintln(args...))
-		return nil, nil
+	"print": func(args []Value) (Value, error) {
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			s, err := ToString(arg)
+			if err != nil {
+				return Nil, err
+			}
+			parts[i] = s
+		}
+		fmt.Fprintln(Output, strings.Join(parts, " "))
+		return Nil, nil
+	},
+
+	"error": func(args []Value) (Value, error) {
+		if len(args) > 1 {
+			return Nil, fmt.Errorf("error expects 0 or 1 argument")
+		}
+		val := String("error")
+		if len(args) == 1 {
+			val = args[0]
+		}
+		return Nil, &ScriptError{Value: val}
 	},
 
-	"input": func(args []interface{}) (interface{}, error) {
+	"pcall": func(args []Value) (Value, error) {
+		if len(args) < 1 {
+			return Nil, fmt.Errorf("pcall expects at least 1 argument (function)")
+		}
+		res, err := Call(args[0], args[1:])
+		if err != nil {
+			return ArrayValue([]Value{False, ErrorValue(err)}), nil
+		}
+		return ArrayValue([]Value{True, res}), nil
+	},
+
+	"input": func(args []Value) (Value, error) {
 		if len(args) > 1 {
-			return nil, fmt.Errorf("input expects 0 or 1 argument (prompt)")
+			return Nil, fmt.Errorf("input expects 0 or 1 argument (prompt)")
 		}
 
 		if len(args) == 1 {
-			if prompt, ok := args[0].(string); ok {
+			if prompt, ok := args[0].Str(); ok {
 				fmt.Print(prompt)
 			} else {
-				return nil, fmt.Errorf("input prompt must be string")
+				return Nil, fmt.Errorf("input prompt must be string")
 			}
 		}
 
 		reader := bufio.NewReader(os.Stdin)
 		text, err := reader.ReadString('\n')
 		if err != nil {
-			return nil, fmt.Errorf("failed to read input: %v", err)
+			return Nil, fmt.Errorf("failed to read input: %v", err)
 		}
 
 		text = strings.TrimSuffix(text, "\n")
 		text = strings.TrimSuffix(text, "\r")
 
-		return text, nil
+		return String(text), nil
 	},
 
-	"args": func(args []interface{}) (interface{}, error) {
+	"args": func(args []Value) (Value, error) {
 		if len(args) > 0 {
-			return nil, fmt.Errorf("args expects 0 arguments")
+			return Nil, fmt.Errorf("args expects 0 arguments")
 		}
 
 		cmdArgs := os.Args[1:]
-		result := make([]interface{}, len(cmdArgs))
+		result := make([]Value, len(cmdArgs))
 		for i, arg := range cmdArgs {
-			result[i] = arg
+			result[i] = String(arg)
 		}
 
-		return result, nil
+		return ArrayValue(result), nil
 	},
 
-	"range": func(args []interface{}) (interface{}, error) {
+	"range": func(args []Value) (Value, error) {
+		nums, err := numbers("range", args)
+		if err != nil {
+			return Nil, err
+		}
 		switch len(args) {
 		case 1:
-			end := int(toFloat64(args[0]))
-			result := make([]interface{}, end)
+			end := int(nums[0])
+			if end < 0 {
+				end = 0
+			}
+			result := make([]Value, end)
 			for i := 0; i < end; i++ {
-				result[i] = float64(i)
+				result[i] = Number(float64(i))
 			}
-			return result, nil
+			return ArrayValue(result), nil
 		case 2:
-			start := int(toFloat64(args[0]))
-			end := int(toFloat64(args[1]))
-			result := make([]interface{}, end-start)
+			start := int(nums[0])
+			end := int(nums[1])
+			if end < start {
+				end = start
+			}
+			result := make([]Value, end-start)
 			for i := start; i < end; i++ {
-				result[i-start] = float64(i)
+				result[i-start] = Number(float64(i))
 			}
-			return result, nil
+			return ArrayValue(result), nil
 		case 3:
-			start := int(toFloat64(args[0]))
-			end := int(toFloat64(args[1]))
-			step := int(toFloat64(args[2]))
+			start := int(nums[0])
+			end := int(nums[1])
+			step := int(nums[2])
 			if step == 0 {
-				return nil, fmt.Errorf("range step cannot be 0")
+				return Nil, fmt.Errorf("range step cannot be 0")
 			}
 
 			size := 0
@@ -111,625 +173,625 @@ var Builtins = map[string]BuiltinFunc{
 				size = 0
 			}
 
-			result := make([]interface{}, size)
+			result := make([]Value, size)
 			for i := 0; i < size; i++ {
-				result[i] = float64(start + i*step)
+				result[i] = Number(float64(start + i*step))
 			}
-			return result, nil
+			return ArrayValue(result), nil
 		default:
-			return nil, fmt.Errorf("range expects 1-3 arguments")
+			return Nil, fmt.Errorf("range expects 1-3 arguments")
 		}
 	},
 
-	"pairs": func(args []interface{}) (interface{}, error) {
+	"pairs": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("pairs expects 1 argument")
+			return Nil, fmt.Errorf("pairs expects 1 argument")
 		}
 
-		switch v := args[0].(type) {
-		case map[string]interface{}:
-			pairs := make([]interface{}, 0, len(v))
-			for key, val := range v {
-				pair := []interface{}{key, val}
-				pairs = append(pairs, pair)
+		if t, ok := args[0].Table(); ok {
+			pairs := make([]Value, 0, len(t))
+			for key, val := range t {
+				if key == MetaKey {
+					continue
+				}
+				pairs = append(pairs, ArrayValue([]Value{String(key), val}))
 			}
-			return pairs, nil
-		case []interface{}:
-			pairs := make([]interface{}, len(v))
-			for i, val := range v {
-				pairs[i] = []interface{}{float64(i), val}
+			return ArrayValue(pairs), nil
+		}
+		if arr, ok := args[0].Array(); ok {
+			pairs := make([]Value, len(arr))
+			for i, val := range arr {
+				pairs[i] = ArrayValue([]Value{Number(float64(i)), val})
 			}
-			return pairs, nil
-		default:
-			return nil, fmt.Errorf("pairs requires table or array")
+			return ArrayValue(pairs), nil
 		}
+		return Nil, fmt.Errorf("pairs requires table or array")
 	},
 
-	"ipairs": func(args []interface{}) (interface{}, error) {
+	"ipairs": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("ipairs expects 1 argument")
+			return Nil, fmt.Errorf("ipairs expects 1 argument")
 		}
 
-		switch v := args[0].(type) {
-		case []interface{}:
-			pairs := make([]interface{}, 0, len(v))
-			for i, val := range v {
-				pairs = append(pairs, []interface{}{float64(i + 1), val})
-			}
-			return pairs, nil
-		default:
-			return nil, fmt.Errorf("ipairs requires array")
+		arr, ok := args[0].Array()
+		if !ok {
+			return Nil, fmt.Errorf("ipairs requires array")
+		}
+		pairs := make([]Value, len(arr))
+		for i, val := range arr {
+			pairs[i] = ArrayValue([]Value{Number(float64(i + 1)), val})
 		}
+		return ArrayValue(pairs), nil
 	},
 
-	"len": func(args []interface{}) (interface{}, error) {
+	"len": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("len expects 1 argument")
-		}
-		switch v := args[0].(type) {
-		case []interface{}:
-			return float64(len(v)), nil
-		case map[string]interface{}:
-			return float64(len(v)), nil
-		case string:
-			return float64(len(v)), nil
-		default:
-			return nil, fmt.Errorf("len invalid type")
+			return Nil, fmt.Errorf("len expects 1 argument")
+		}
+		if res, ok, err := CallMeta(args[0], "__len", args[0]); ok {
+			return res, err
 		}
+		if arr, ok := args[0].Array(); ok {
+			return Number(float64(len(arr))), nil
+		}
+		if t, ok := args[0].Table(); ok {
+			if _, ok := t[MetaKey]; ok {
+				return Number(float64(len(t) - 1)), nil
+			}
+			return Number(float64(len(t))), nil
+		}
+		if s, ok := args[0].Str(); ok {
+			return Number(float64(len(s))), nil
+		}
+		return Nil, fmt.Errorf("len invalid type")
 	},
 
-	"type": func(args []interface{}) (interface{}, error) {
+	"type": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("type expects 1 argument")
+			return Nil, fmt.Errorf("type expects 1 argument")
 		}
-		return fmt.Sprintf("%T", args[0]), nil
+		return String(args[0].TypeName()), nil
 	},
 
-	"push": func(args []interface{}) (interface{}, error) {
+	"push": func(args []Value) (Value, error) {
 		if len(args) != 2 {
-			return nil, fmt.Errorf("push expects 2 arguments (table, value)")
+			return Nil, fmt.Errorf("push expects 2 arguments (table, value)")
 		}
-		switch tbl := args[0].(type) {
-		case []interface{}:
-			return append(tbl, args[1]), nil
-		default:
-			return nil, fmt.Errorf("push requires array")
+		arr, ok := args[0].Array()
+		if !ok {
+			return Nil, fmt.Errorf("push requires array")
 		}
+		return ArrayValue(append(arr, args[1])), nil
 	},
 
-	"sqrt": func(args []interface{}) (interface{}, error) {
+	"sqrt": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("sqrt expects 1 argument")
+			return Nil, fmt.Errorf("sqrt expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Sqrt(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Sqrt(f)), nil
 		}
-		return nil, fmt.Errorf("sqrt requires number")
+		return Nil, fmt.Errorf("sqrt requires number")
 	},
 
-	"abs": func(args []interface{}) (interface{}, error) {
+	"abs": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("abs expects 1 argument")
+			return Nil, fmt.Errorf("abs expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Abs(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Abs(f)), nil
 		}
-		return nil, fmt.Errorf("abs requires number")
+		return Nil, fmt.Errorf("abs requires number")
 	},
 
-	"pow": func(args []interface{}) (interface{}, error) {
+	"pow": func(args []Value) (Value, error) {
 		if len(args) != 2 {
-			return nil, fmt.Errorf("pow expects 2 arguments (base, exponent)")
+			return Nil, fmt.Errorf("pow expects 2 arguments (base, exponent)")
 		}
-		base, ok1 := args[0].(float64)
-		exp, ok2 := args[1].(float64)
-		if !ok1 || !ok2 {
-			return nil, fmt.Errorf("pow requires numbers")
+		nums, err := numbers("pow", args)
+		if err != nil {
+			return Nil, err
 		}
-		return math.Pow(base, exp), nil
+		return Number(math.Pow(nums[0], nums[1])), nil
 	},
 
-	"sin": func(args []interface{}) (interface{}, error) {
+	"sin": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("sin expects 1 argument")
+			return Nil, fmt.Errorf("sin expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Sin(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Sin(f)), nil
 		}
-		return nil, fmt.Errorf("sin requires number")
+		return Nil, fmt.Errorf("sin requires number")
 	},
 
-	"cos": func(args []interface{}) (interface{}, error) {
+	"cos": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("cos expects 1 argument")
+			return Nil, fmt.Errorf("cos expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Cos(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Cos(f)), nil
 		}
-		return nil, fmt.Errorf("cos requires number")
+		return Nil, fmt.Errorf("cos requires number")
 	},
 
-	"tan": func(args []interface{}) (interface{}, error) {
+	"tan": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("tan expects 1 argument")
+			return Nil, fmt.Errorf("tan expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Tan(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Tan(f)), nil
 		}
-		return nil, fmt.Errorf("tan requires number")
+		return Nil, fmt.Errorf("tan requires number")
 	},
 
-	"log": func(args []interface{}) (interface{}, error) {
+	"log": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("log expects 1 argument")
+			return Nil, fmt.Errorf("log expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Log(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Log(f)), nil
 		}
-		return nil, fmt.Errorf("log requires number")
+		return Nil, fmt.Errorf("log requires number")
 	},
 
-	"exp": func(args []interface{}) (interface{}, error) {
+	"exp": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("exp expects 1 argument")
+			return Nil, fmt.Errorf("exp expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Exp(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Exp(f)), nil
 		}
-		return nil, fmt.Errorf("exp requires number")
+		return Nil, fmt.Errorf("exp requires number")
 	},
 
-	"floor": func(args []interface{}) (interface{}, error) {
+	"floor": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("floor expects 1 argument")
+			return Nil, fmt.Errorf("floor expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Floor(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Floor(f)), nil
 		}
-		return nil, fmt.Errorf("floor requires number")
+		return Nil, fmt.Errorf("floor requires number")
 	},
 
-	"clamp": func(args []interface{}) (interface{}, error) {
+	"clamp": func(args []Value) (Value, error) {
 		if len(args) != 3 {
-			return nil, fmt.Errorf("clamp expects 3 arguments (value, min, max)")
+			return Nil, fmt.Errorf("clamp expects 3 arguments (value, min, max)")
 		}
 
-		val, ok1 := args[0].(float64)
-		min, ok2 := args[1].(float64)
-		max, ok3 := args[2].(float64)
-		if !ok1 || !ok2 || !ok3 {
-			return nil, fmt.Errorf("clamp requires numbers")
+		nums, err := numbers("clamp", args)
+		if err != nil {
+			return Nil, err
 		}
 
+		val, min, max := nums[0], nums[1], nums[2]
 		if val < min {
-			return min, nil
+			return Number(min), nil
 		}
 		if val > max {
-			return max, nil
+			return Number(max), nil
 		}
-		return val, nil
+		return Number(val), nil
 	},
 
-	"lerp": func(args []interface{}) (interface{}, error) {
+	"lerp": func(args []Value) (Value, error) {
 		if len(args) != 3 {
-			return nil, fmt.Errorf("lerp expects 3 arguments (a, b, t)")
+			return Nil, fmt.Errorf("lerp expects 3 arguments (a, b, t)")
 		}
 
-		a, ok1 := args[0].(float64)
-		b, ok2 := args[1].(float64)
-		t, ok3 := args[2].(float64)
-		if !ok1 || !ok2 || !ok3 {
-			return nil, fmt.Errorf("lerp requires numbers")
+		nums, err := numbers("lerp", args)
+		if err != nil {
+			return Nil, err
 		}
 
-		return a + t*(b-a), nil
+		a, b, t := nums[0], nums[1], nums[2]
+		return Number(a + t*(b-a)), nil
 	},
 
-	"ceil": func(args []interface{}) (interface{}, error) {
+	"ceil": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("ceil expects 1 argument")
+			return Nil, fmt.Errorf("ceil expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Ceil(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Ceil(f)), nil
 		}
-		return nil, fmt.Errorf("ceil requires number")
+		return Nil, fmt.Errorf("ceil requires number")
 	},
 
-	"round": func(args []interface{}) (interface{}, error) {
+	"round": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("round expects 1 argument")
+			return Nil, fmt.Errorf("round expects 1 argument")
 		}
-		if f, ok := args[0].(float64); ok {
-			return math.Round(f), nil
+		if f, ok := args[0].Num(); ok {
+			return Number(math.Round(f)), nil
 		}
-		return nil, fmt.Errorf("round requires number")
+		return Nil, fmt.Errorf("round requires number")
 	},
 
-	"max": func(args []interface{}) (interface{}, error) {
+	"max": func(args []Value) (Value, error) {
 		if len(args) < 1 {
-			return nil, fmt.Errorf("max expects at least 1 argument")
+			return Nil, fmt.Errorf("max expects at least 1 argument")
+		}
+		nums, err := numbers("max", args)
+		if err != nil {
+			return Nil, err
 		}
 		maxVal := math.Inf(-1)
-		for _, arg := range args {
-			if f, ok := arg.(float64); ok {
-				if f > maxVal {
-					maxVal = f
-				}
-			} else {
-				return nil, fmt.Errorf("max requires numbers")
+		for _, f := range nums {
+			if f > maxVal {
+				maxVal = f
 			}
 		}
-		return maxVal, nil
+		return Number(maxVal), nil
 	},
 
-	"min": func(args []interface{}) (interface{}, error) {
+	"min": func(args []Value) (Value, error) {
 		if len(args) < 1 {
-			return nil, fmt.Errorf("min expects at least 1 argument")
+			return Nil, fmt.Errorf("min expects at least 1 argument")
+		}
+		nums, err := numbers("min", args)
+		if err != nil {
+			return Nil, err
 		}
 		minVal := math.Inf(1)
-		for _, arg := range args {
-			if f, ok := arg.(float64); ok {
-				if f < minVal {
-					minVal = f
-				}
-			} else {
-				return nil, fmt.Errorf("min requires numbers")
+		for _, f := range nums {
+			if f < minVal {
+				minVal = f
 			}
 		}
-		return minVal, nil
+		return Number(minVal), nil
 	},
 
-	"substr": func(args []interface{}) (interface{}, error) {
+	"substr": func(args []Value) (Value, error) {
 		if len(args) != 3 {
-			return nil, fmt.Errorf("substr expects 3 arguments (string, start, length)")
+			return Nil, fmt.Errorf("substr expects 3 arguments (string, start, length)")
 		}
-		str, ok1 := args[0].(string)
-		start, ok2 := args[1].(float64)
-		length, ok3 := args[2].(float64)
+		str, ok1 := args[0].Str()
+		start, ok2 := args[1].Num()
+		length, ok3 := args[2].Num()
 		if !ok1 || !ok2 || !ok3 {
-			return nil, fmt.Errorf("substr requires (string, number, number)")
+			return Nil, fmt.Errorf("substr requires (string, number, number)")
 		}
 
 		s := int(start)
 		l := int(length)
 		if s < 0 || s >= len(str) || l < 0 {
-			return "", nil
+			return String(""), nil
 		}
 		if s+l > len(str) {
 			l = len(str) - s
 		}
-		return str[s : s+l], nil
+		return String(str[s : s+l]), nil
 	},
 
-	"concat": func(args []interface{}) (interface{}, error) {
+	"concat": func(args []Value) (Value, error) {
 		result := ""
 		for _, arg := range args {
-			result += fmt.Sprintf("%v", arg)
+			s, err := ToString(arg)
+			if err != nil {
+				return Nil, err
+			}
+			result += s
 		}
-		return result, nil
+		return String(result), nil
 	},
 
-	"upper": func(args []interface{}) (interface{}, error) {
+	"upper": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("upper expects 1 argument")
+			return Nil, fmt.Errorf("upper expects 1 argument")
 		}
-		if s, ok := args[0].(string); ok {
-			return strings.ToUpper(s), nil
+		if s, ok := args[0].Str(); ok {
+			return String(strings.ToUpper(s)), nil
 		}
-		return nil, fmt.Errorf("upper requires string")
+		return Nil, fmt.Errorf("upper requires string")
 	},
 
-	"lower": func(args []interface{}) (interface{}, error) {
+	"lower": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("lower expects 1 argument")
+			return Nil, fmt.Errorf("lower expects 1 argument")
 		}
-		if s, ok := args[0].(string); ok {
-			return strings.ToLower(s), nil
+		if s, ok := args[0].Str(); ok {
+			return String(strings.ToLower(s)), nil
 		}
-		return nil, fmt.Errorf("lower requires string")
+		return Nil, fmt.Errorf("lower requires string")
 	},
 
-	"split": func(args []interface{}) (interface{}, error) {
+	"split": func(args []Value) (Value, error) {
 		if len(args) != 1 && len(args) != 2 {
-			return nil, fmt.Errorf("split expects 1 or 2 arguments")
+			return Nil, fmt.Errorf("split expects 1 or 2 arguments")
 		}
-		if s, ok := args[0].(string); ok {
+		if s, ok := args[0].Str(); ok {
 			sep := " "
 			if len(args) == 2 {
-				if sepStr, ok := args[1].(string); ok {
+				if sepStr, ok := args[1].Str(); ok {
 					sep = sepStr
 				} else {
-					return nil, fmt.Errorf("split separator must be string")
+					return Nil, fmt.Errorf("split separator must be string")
 				}
 			}
 			parts := strings.Split(s, sep)
-			result := make([]interface{}, len(parts))
+			result := make([]Value, len(parts))
 			for i, p := range parts {
-				result[i] = p
+				result[i] = String(p)
 			}
-			return result, nil
+			return ArrayValue(result), nil
 		}
-		return nil, fmt.Errorf("split requires string")
+		return Nil, fmt.Errorf("split requires string")
 	},
 
-	"find": func(args []interface{}) (interface{}, error) {
+	"find": func(args []Value) (Value, error) {
 		if len(args) != 2 {
-			return nil, fmt.Errorf("find expects 2 arguments (string, substring)")
+			return Nil, fmt.Errorf("find expects 2 arguments (string, substring)")
 		}
-		if s, ok1 := args[0].(string); ok1 {
-			if sub, ok2 := args[1].(string); ok2 {
+		if s, ok1 := args[0].Str(); ok1 {
+			if sub, ok2 := args[1].Str(); ok2 {
 				index := strings.Index(s, sub)
-				return float64(index), nil
+				return Number(float64(index)), nil
 			}
 		}
-		return nil, fmt.Errorf("find requires strings")
+		return Nil, fmt.Errorf("find requires strings")
 	},
 
-	"replace": func(args []interface{}) (interface{}, error) {
+	"replace": func(args []Value) (Value, error) {
 		if len(args) != 3 {
-			return nil, fmt.Errorf("replace expects 3 arguments (string, old, new)")
+			return Nil, fmt.Errorf("replace expects 3 arguments (string, old, new)")
 		}
-		if s, ok1 := args[0].(string); ok1 {
-			if old, ok2 := args[1].(string); ok2 {
-				if new, ok3 := args[2].(string); ok3 {
-					return strings.ReplaceAll(s, old, new), nil
+		if s, ok1 := args[0].Str(); ok1 {
+			if old, ok2 := args[1].Str(); ok2 {
+				if new, ok3 := args[2].Str(); ok3 {
+					return String(strings.ReplaceAll(s, old, new)), nil
 				}
 			}
 		}
-		return nil, fmt.Errorf("replace requires strings")
+		return Nil, fmt.Errorf("replace requires strings")
 	},
 
-	"pop": func(args []interface{}) (interface{}, error) {
+	"pop": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("pop expects 1 argument (array)")
+			return Nil, fmt.Errorf("pop expects 1 argument (array)")
 		}
-		switch arr := args[0].(type) {
-		case []interface{}:
-			if len(arr) == 0 {
-				return arr, nil
-			}
-			return arr[:len(arr)-1], nil
-		default:
-			return nil, fmt.Errorf("pop requires array")
+		arr, ok := args[0].Array()
+		if !ok {
+			return Nil, fmt.Errorf("pop requires array")
 		}
+		if len(arr) == 0 {
+			return args[0], nil
+		}
+		return ArrayValue(arr[:len(arr)-1]), nil
 	},
 
-	"keys": func(args []interface{}) (interface{}, error) {
+	"keys": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("keys expects 1 argument")
+			return Nil, fmt.Errorf("keys expects 1 argument")
+		}
+		m, ok := args[0].Table()
+		if !ok {
+			return Nil, fmt.Errorf("keys requires map")
 		}
-		switch m := args[0].(type) {
-		case map[string]interface{}:
-			keys := make([]interface{}, 0, len(m))
-			for k := range m {
-				keys = append(keys, k)
+		keys := make([]Value, 0, len(m))
+		for k := range m {
+			if k != MetaKey {
+				keys = append(keys, String(k))
 			}
-			return keys, nil
-		default:
-			return nil, fmt.Errorf("keys requires map")
 		}
+		return ArrayValue(keys), nil
 	},
 
-	"tick": func(args []interface{}) (interface{}, error) {
+	"tick": func(args []Value) (Value, error) {
 		if len(args) != 0 {
-			return nil, fmt.Errorf("tick expects 0 arguments")
+			return Nil, fmt.Errorf("tick expects 0 arguments")
 		}
 		now := time.Now()
-		return float64(now.Unix()) + float64(now.Nanosecond())/1e9, nil
+		return Number(float64(now.Unix()) + float64(now.Nanosecond())/1e9), nil
 	},
 
-	"time": func(args []interface{}) (interface{}, error) {
+	"time": func(args []Value) (Value, error) {
 		if len(args) != 0 {
-			return nil, fmt.Errorf("time expects 0 arguments")
+			return Nil, fmt.Errorf("time expects 0 arguments")
 		}
-		return float64(time.Now().Unix()), nil
+		return Number(float64(time.Now().Unix())), nil
 	},
 
-	"date": func(args []interface{}) (interface{}, error) {
+	"date": func(args []Value) (Value, error) {
 		now := time.Now()
 		if len(args) == 0 {
-			return map[string]interface{}{
-				"year":  float64(now.Year()),
-				"month": float64(now.Month()),
-				"day":   float64(now.Day()),
-				"hour":  float64(now.Hour()),
-				"min":   float64(now.Minute()),
-				"sec":   float64(now.Second()),
-				"wday":  float64(now.Weekday()),
-				"yday":  float64(now.YearDay()),
-				"isdst": now.IsDST(),
-				"epoch": float64(now.Unix()),
-				"tick":  float64(now.Unix()) + float64(now.Nanosecond())/1e9,
-			}, nil
+			return dateTable(now, float64(now.Unix())+float64(now.Nanosecond())/1e9), nil
 		}
 
 		if len(args) == 1 {
-			if ts, ok := args[0].(float64); ok {
+			if ts, ok := args[0].Num(); ok {
 				seconds := int64(ts)
 				nanoseconds := int64((ts - float64(seconds)) * 1e9)
-				t := time.Unix(seconds, nanoseconds)
-				return map[string]interface{}{
-					"year":  float64(t.Year()),
-					"month": float64(t.Month()),
-					"day":   float64(t.Day()),
-					"hour":  float64(t.Hour()),
-					"min":   float64(t.Minute()),
-					"sec":   float64(t.Second()),
-					"wday":  float64(t.Weekday()),
-					"yday":  float64(t.YearDay()),
-					"isdst": t.IsDST(),
-					"epoch": float64(t.Unix()),
-					"tick":  ts,
-				}, nil
+				return dateTable(time.Unix(seconds, nanoseconds), ts), nil
 			}
-			return nil, fmt.Errorf("date requires number or no arguments")
+			return Nil, fmt.Errorf("date requires number or no arguments")
 		}
 
-		return nil, fmt.Errorf("date expects 0 or 1 argument")
+		return Nil, fmt.Errorf("date expects 0 or 1 argument")
 	},
 
-	"wait": func(args []interface{}) (interface{}, error) {
+	"wait": func(args []Value) (Value, error) {
 		var seconds float64 = 0
 		if len(args) == 1 {
-			if s, ok := args[0].(float64); ok {
+			if s, ok := args[0].Num(); ok {
 				seconds = s
 			} else {
-				return nil, fmt.Errorf("wait requires number")
+				return Nil, fmt.Errorf("wait requires number")
 			}
 		} else if len(args) > 1 {
-			return nil, fmt.Errorf("wait expects 0 or 1 argument")
+			return Nil, fmt.Errorf("wait expects 0 or 1 argument")
 		}
 
 		duration := time.Duration(seconds * float64(time.Second))
 		time.Sleep(duration)
-		return seconds, nil
+		return Number(seconds), nil
 	},
 
-	"random": func(args []interface{}) (interface{}, error) {
+	"random": func(args []Value) (Value, error) {
 		if len(args) > 2 {
-			return nil, fmt.Errorf("random expects 0, 1, or 2 arguments")
+			return Nil, fmt.Errorf("random expects 0, 1, or 2 arguments")
 		}
 
 		if len(args) == 0 {
-			return float64(rand.Intn(1 - 0)), nil
+			return Number(float64(rand.Intn(1 - 0))), nil
 		}
 
 		if len(args) == 1 {
-			if max, ok := args[0].(float64); ok {
+			if max, ok := args[0].Num(); ok {
 				if max <= 0 {
-					return nil, fmt.Errorf("random max must be positive")
+					return Nil, fmt.Errorf("random max must be positive")
 				}
-				return float64(rand.Intn(int(max))), nil
+				return Number(float64(rand.Intn(int(max)))), nil
 			}
-			return nil, fmt.Errorf("random requires number")
+			return Nil, fmt.Errorf("random requires number")
 		}
 
-		min, ok1 := args[0].(float64)
-		max, ok2 := args[1].(float64)
-		if !ok1 || !ok2 {
-			return nil, fmt.Errorf("random requires numbers")
+		nums, err := numbers("random", args)
+		if err != nil {
+			return Nil, err
 		}
+		min, max := nums[0], nums[1]
 		if max <= min {
-			return nil, fmt.Errorf("random max must be greater than min")
+			return Nil, fmt.Errorf("random max must be greater than min")
 		}
-		return min + float64(rand.Intn(int(max-min))), nil
+		return Number(min + float64(rand.Intn(int(max-min)))), nil
 	},
 
-	"tostring": func(args []interface{}) (interface{}, error) {
+	"tostring": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("tostring() expects 1 argument")
+			return Nil, fmt.Errorf("tostring() expects 1 argument")
+		}
+		s, err := ToString(args[0])
+		if err != nil {
+			return Nil, err
 		}
-		return fmt.Sprintf("%v", args[0]), nil
+		return String(s), nil
 	},
 
-	"tonumber": func(args []interface{}) (interface{}, error) {
+	"tonumber": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("tonumber() expects 1 argument")
+			return Nil, fmt.Errorf("tonumber() expects 1 argument")
 		}
-		switch v := args[0].(type) {
-		case float64:
-			return v, nil
-		case string:
+		if _, ok := args[0].Num(); ok {
+			return args[0], nil
+		}
+		if s, ok := args[0].Str(); ok {
 			var f float64
-			_, err := fmt.Sscanf(v, "%f", &f)
+			_, err := fmt.Sscanf(s, "%f", &f)
 			if err != nil {
-				return nil, fmt.Errorf("cannot convert string to number")
+				return Nil, fmt.Errorf("cannot convert string to number")
 			}
-			return f, nil
-		default:
-			return nil, fmt.Errorf("cannot convert to number")
+			return Number(f), nil
 		}
+		return Nil, fmt.Errorf("cannot convert to number")
 	},
-	"writefile": func(args []interface{}) (interface{}, error) {
+	"writefile": func(args []Value) (Value, error) {
 		if len(args) != 2 {
-			return nil, fmt.Errorf("writefile expects 2 arguments (filename, content)")
+			return Nil, fmt.Errorf("writefile expects 2 arguments (filename, content)")
 		}
 
-		filename, ok1 := args[0].(string)
+		filename, ok1 := args[0].Str()
 		if !ok1 {
-			return nil, fmt.Errorf("writefile filename must be string")
+			return Nil, fmt.Errorf("writefile filename must be string")
 		}
 
-		content := fmt.Sprintf("%v", args[1])
+		content := args[1].String()
 
 		dir := filepath.Dir(filename)
 		if dir != "" && dir != "." {
 			if err := os.MkdirAll(dir, 0755); err != nil {
-				return nil, fmt.Errorf("failed to create directory: %v", err)
+				return Nil, fmt.Errorf("failed to create directory: %v", err)
 			}
 		}
 
 		err := ioutil.WriteFile(filename, []byte(content), 0644)
 		if err != nil {
-			return nil, fmt.Errorf("failed to write file: %v", err)
+			return Nil, fmt.Errorf("failed to write file: %v", err)
 		}
 
-		return nil, nil
+		return Nil, nil
 	},
 
-	"readfile": func(args []interface{}) (interface{}, error) {
+	"readfile": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("readfile expects 1 argument (filename)")
+			return Nil, fmt.Errorf("readfile expects 1 argument (filename)")
 		}
 
-		filename, ok := args[0].(string)
+		filename, ok := args[0].Str()
 		if !ok {
-			return nil, fmt.Errorf("readfile filename must be string")
+			return Nil, fmt.Errorf("readfile filename must be string")
 		}
 
 		data, err := ioutil.ReadFile(filename)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read file: %v", err)
+			return Nil, fmt.Errorf("failed to read file: %v", err)
 		}
 
-		return string(data), nil
+		return String(string(data)), nil
 	},
 
-	"makedir": func(args []interface{}) (interface{}, error) {
+	"makedir": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("makedir expects 1 argument (dirname)")
+			return Nil, fmt.Errorf("makedir expects 1 argument (dirname)")
 		}
 
-		dirname, ok := args[0].(string)
+		dirname, ok := args[0].Str()
 		if !ok {
-			return nil, fmt.Errorf("makedir dirname must be string")
+			return Nil, fmt.Errorf("makedir dirname must be string")
 		}
 
 		err := os.MkdirAll(dirname, 0755)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create directory: %v", err)
+			return Nil, fmt.Errorf("failed to create directory: %v", err)
 		}
 
-		return nil, nil
+		return Nil, nil
 	},
 
-	"gotodir": func(args []interface{}) (interface{}, error) {
+	"gotodir": func(args []Value) (Value, error) {
 		if len(args) != 1 {
-			return nil, fmt.Errorf("gotodir expects 1 argument (dirname)")
+			return Nil, fmt.Errorf("gotodir expects 1 argument (dirname)")
 		}
 
-		dirname, ok := args[0].(string)
+		dirname, ok := args[0].Str()
 		if !ok {
-			return nil, fmt.Errorf("gotodir dirname must be string")
+			return Nil, fmt.Errorf("gotodir dirname must be string")
 		}
 
 		info, err := os.Stat(dirname)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, fmt.Errorf("directory does not exist: %s", dirname)
+				return Nil, fmt.Errorf("directory does not exist: %s", dirname)
 			}
-			return nil, fmt.Errorf("failed to access directory: %v", err)
+			return Nil, fmt.Errorf("failed to access directory: %v", err)
 		}
 
 		if !info.IsDir() {
-			return nil, fmt.Errorf("not a directory: %s", dirname)
+			return Nil, fmt.Errorf("not a directory: %s", dirname)
 		}
 
 		err = os.Chdir(dirname)
 		if err != nil {
-			return nil, fmt.Errorf("failed to change directory: %v", err)
+			return Nil, fmt.Errorf("failed to change directory: %v", err)
 		}
 
-		return nil, nil
+		return Nil, nil
 	},
 }
+
+func dateTable(t time.Time, tick float64) Value {
+	return TableValue(map[string]Value{
+		"year":  Number(float64(t.Year())),
+		"month": Number(float64(t.Month())),
+		"day":   Number(float64(t.Day())),
+		"hour":  Number(float64(t.Hour())),
+		"min":   Number(float64(t.Minute())),
+		"sec":   Number(float64(t.Second())),
+		"wday":  Number(float64(t.Weekday())),
+		"yday":  Number(float64(t.YearDay())),
+		"isdst": Bool(t.IsDST()),
+		"epoch": Number(float64(t.Unix())),
+		"tick":  Number(tick),
+	})
+}
@@ -0,0 +1,115 @@
+package builtins
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MetaKey is the hidden table slot holding a table's metatable. It can't be
+// written from scripts because string literals can't contain a NUL byte.
+const MetaKey = "\x00meta"
+
+// Call lets builtins invoke script functions (metamethods, callbacks). The VM
+// sets it before running.
+var Call func(fn Value, args []Value) (Value, error)
+
+func GetMetatable(val Value) map[string]Value {
+	t, ok := val.Table()
+	if !ok {
+		return nil
+	}
+	mt, _ := t[MetaKey].Table()
+	return mt
+}
+
+func Metamethod(val Value, event string) Value {
+	if mt := GetMetatable(val); mt != nil {
+		return mt[event]
+	}
+	return Nil
+}
+
+// CallMeta calls the given metamethod of val if it has one.
+func CallMeta(val Value, event string, args ...Value) (Value, bool, error) {
+	fn := Metamethod(val, event)
+	if fn.IsNil() || Call == nil {
+		return Nil, false, nil
+	}
+	res, err := Call(fn, args)
+	return res, true, err
+}
+
+func ToString(val Value) (string, error) {
+	if res, ok, err := CallMeta(val, "__tostring", val); ok {
+		if err != nil {
+			return "", err
+		}
+		if s, ok := res.Str(); ok {
+			return s, nil
+		}
+		return "", fmt.Errorf("'__tostring' must return a string")
+	}
+
+	if arr, ok := val.Array(); ok {
+		parts := make([]string, len(arr))
+		for i, item := range arr {
+			s, err := ToString(item)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return "[" + strings.Join(parts, " ") + "]", nil
+	}
+	if t, ok := val.Table(); ok {
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			if k != MetaKey {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			s, err := ToString(t[k])
+			if err != nil {
+				return "", err
+			}
+			parts[i] = k + ":" + s
+		}
+		return "map[" + strings.Join(parts, " ") + "]", nil
+	}
+	return val.String(), nil
+}
+
+func init() {
+	Builtins["setmetatable"] = func(args []Value) (Value, error) {
+		if len(args) != 2 {
+			return Nil, fmt.Errorf("setmetatable expects 2 arguments (table, metatable)")
+		}
+		t, ok := args[0].Table()
+		if !ok {
+			return Nil, fmt.Errorf("setmetatable requires table")
+		}
+		switch args[1].Kind() {
+		case NilKind:
+			delete(t, MetaKey)
+		case TableKind:
+			t[MetaKey] = args[1]
+		default:
+			return Nil, fmt.Errorf("setmetatable metatable must be table or nil")
+		}
+		return args[0], nil
+	}
+
+	Builtins["getmetatable"] = func(args []Value) (Value, error) {
+		if len(args) != 1 {
+			return Nil, fmt.Errorf("getmetatable expects 1 argument")
+		}
+		if mt := GetMetatable(args[0]); mt != nil {
+			return TableValue(mt), nil
+		}
+		return Nil, nil
+	}
+}
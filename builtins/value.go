@@ -0,0 +1,160 @@
+package builtins
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Kind tags what a Value holds.
+type Kind uint8
+
+const (
+	NilKind Kind = iota
+	NumberKind
+	BoolKind
+	StringKind
+	TableKind
+	ArrayKind
+)
+
+// Value is a script value. Numbers and booleans live in num, so pushing them
+// never allocates; strings, tables and arrays are kept in ref.
+type Value struct {
+	kind Kind
+	num  float64
+	ref  interface{}
+}
+
+var (
+	Nil   = Value{}
+	True  = Value{kind: BoolKind, num: 1}
+	False = Value{kind: BoolKind}
+)
+
+func Number(f float64) Value {
+	return Value{kind: NumberKind, num: f}
+}
+
+func Bool(b bool) Value {
+	if b {
+		return True
+	}
+	return False
+}
+
+func String(s string) Value {
+	return Value{kind: StringKind, ref: s}
+}
+
+func TableValue(t map[string]Value) Value {
+	return Value{kind: TableKind, ref: t}
+}
+
+func ArrayValue(a []Value) Value {
+	return Value{kind: ArrayKind, ref: a}
+}
+
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+func (v Value) IsNil() bool {
+	return v.kind == NilKind
+}
+
+// Num returns the number held by v and whether it is one.
+func (v Value) Num() (float64, bool) {
+	return v.num, v.kind == NumberKind
+}
+
+func (v Value) Str() (string, bool) {
+	if v.kind != StringKind {
+		return "", false
+	}
+	return v.ref.(string), true
+}
+
+func (v Value) Table() (map[string]Value, bool) {
+	if v.kind != TableKind {
+		return nil, false
+	}
+	return v.ref.(map[string]Value), true
+}
+
+func (v Value) Array() ([]Value, bool) {
+	if v.kind != ArrayKind {
+		return nil, false
+	}
+	return v.ref.([]Value), true
+}
+
+// Truthy reports whether v counts as true in a condition: everything but
+// nil, false, 0 and the empty string.
+func (v Value) Truthy() bool {
+	switch v.kind {
+	case NilKind:
+		return false
+	case NumberKind, BoolKind:
+		return v.num != 0
+	case StringKind:
+		return v.ref.(string) != ""
+	}
+	return true
+}
+
+// Same reports whether a and b are the same value: equal numbers, booleans
+// or strings, or the very same table or array.
+func Same(a, b Value) bool {
+	if a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case NilKind:
+		return true
+	case NumberKind, BoolKind:
+		return a.num == b.num
+	case StringKind:
+		return a.ref.(string) == b.ref.(string)
+	case TableKind:
+		return reflect.ValueOf(a.ref).UnsafePointer() == reflect.ValueOf(b.ref).UnsafePointer()
+	case ArrayKind:
+		at, bt := a.ref.([]Value), b.ref.([]Value)
+		return len(at) == len(bt) && (len(at) == 0 || &at[0] == &bt[0])
+	}
+	return false
+}
+
+// TypeName is what type() reports. The names are the ones scripts saw back
+// when values were plain Go interfaces.
+func (v Value) TypeName() string {
+	switch v.kind {
+	case NumberKind:
+		return "float64"
+	case BoolKind:
+		return "bool"
+	case StringKind:
+		return "string"
+	case TableKind:
+		return "map[string]interface {}"
+	case ArrayKind:
+		return "[]interface {}"
+	}
+	return "<nil>"
+}
+
+// String formats v the way fmt prints the matching Go value, without
+// metamethods; use ToString for the script-visible form.
+func (v Value) String() string {
+	switch v.kind {
+	case NilKind:
+		return "<nil>"
+	case NumberKind:
+		return strconv.FormatFloat(v.num, 'g', -1, 64)
+	case BoolKind:
+		return strconv.FormatBool(v.num != 0)
+	case StringKind:
+		return v.ref.(string)
+	}
+	return fmt.Sprint(v.ref)
+}
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
 	"os"
+	"sort"
+	"strings"
 )
 
 const (
 	MagicHeader           = 0x4C4C4243
-	VersionMajor    uint8 = 3
+	VersionMajor    uint8 = 4
 	VersionMinor    uint8 = 0
 	VersionCombined       = (VersionMajor << 4) | (VersionMinor & 0x0F)
 
+	SectionStrings   = 1
+	SectionMeta      = 2
+	SectionConstants = 3
+	SectionFunctions = 4
+	SectionCode      = 5
+	SectionLines     = 6
+	SectionModules   = 7
+
+	FlagCompressed = 1 << 0
+	FlagStripped   = 1 << 1
+
 	ConstTypeNumber   = 0
 	ConstTypeString   = 1
 	ConstTypeFuncPtr  = 2
@@ -27,6 +44,14 @@ const (
 	ArgTypeString = 3
 )
 
+// ModuleEntry locates one linked module inside a bytecode image. The first
+// entry of an image is its main program.
+type ModuleEntry struct {
+	Name  string
+	Start int
+	End   int
+}
+
 type BitWriter struct {
 	writer io.Writer
 	buffer byte
@@ -38,6 +63,12 @@ func NewBitWriter(w io.Writer) *BitWriter {
 }
 
 func (bw *BitWriter) WriteBits(value uint64, bits uint8) error {
+	if bw.bitPos == 0 && bits%8 == 0 {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], value)
+		_, err := bw.writer.Write(buf[:bits/8])
+		return err
+	}
 	for i := uint8(0); i < bits; i++ {
 		bit := (value >> i) & 1
 		bw.buffer |= byte(bit << bw.bitPos)
@@ -100,10 +131,15 @@ func (bw *BitWriter) WriteVarInt(val int32) error {
 	return bw.WriteVarUint(uval)
 }
 
+// BitReader reads ahead in chunks and keeps the bits of the bytes it has
+// started in a word, so a read of any width takes them all at once instead
+// of one bit at a time.
 type BitReader struct {
 	reader io.Reader
-	buffer byte
-	bitPos uint8
+	chunk  []byte
+	pos    int
+	bits   uint64
+	nbits  uint8
 	eof    bool
 }
 
@@ -111,29 +147,81 @@ func NewBitReader(r io.Reader) *BitReader {
 	return &BitReader{reader: r}
 }
 
+// nextByte returns the next unread byte of the input.
+func (br *BitReader) nextByte() (byte, error) {
+	if br.pos == len(br.chunk) {
+		if br.eof {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if br.chunk == nil {
+			br.chunk = make([]byte, 4096)
+		}
+		n, err := io.ReadFull(br.reader, br.chunk[:cap(br.chunk)])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			br.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		br.chunk, br.pos = br.chunk[:n], 0
+	}
+	b := br.chunk[br.pos]
+	br.pos++
+	return b, nil
+}
+
+// ReadBits reads up to 64 bits, lowest first.
 func (br *BitReader) ReadBits(bits uint8) (uint64, error) {
-	var result uint64
-	for i := uint8(0); i < bits; i++ {
-		if br.bitPos == 0 && !br.eof {
-			var buf [1]byte
-			n, err := br.reader.Read(buf[:])
-			if err != nil && err != io.EOF {
+	if bits > 56 {
+		low, err := br.ReadBits(32)
+		if err != nil {
+			return 0, err
+		}
+		high, err := br.ReadBits(bits - 32)
+		return low | high<<32, err
+	}
+	for br.nbits < bits {
+		var b byte
+		if br.pos < len(br.chunk) {
+			b = br.chunk[br.pos]
+			br.pos++
+		} else {
+			var err error
+			if b, err = br.nextByte(); err != nil {
 				return 0, err
 			}
-			if n == 0 {
-				br.eof = true
-				return 0, io.ErrUnexpectedEOF
-			}
-			br.buffer = buf[0]
 		}
-
-		bit := (br.buffer >> br.bitPos) & 1
-		result |= uint64(bit) << i
-		br.bitPos = (br.bitPos + 1) % 8
+		br.bits |= uint64(b) << br.nbits
+		br.nbits += 8
 	}
+	result := br.bits & (1<<bits - 1)
+	br.bits >>= bits
+	br.nbits -= bits
 	return result, nil
 }
 
+// ReadBytes fills p with the next len(p) bytes, which need not start on a
+// byte boundary.
+func (br *BitReader) ReadBytes(p []byte) error {
+	for i := 0; i < len(p); {
+		if br.nbits == 0 && br.pos < len(br.chunk) {
+			n := copy(p[i:], br.chunk[br.pos:])
+			br.pos += n
+			i += n
+			continue
+		}
+		b, err := br.ReadBits(8)
+		if err != nil {
+			return err
+		}
+		p[i] = byte(b)
+		i++
+	}
+	return nil
+}
+
 func (br *BitReader) ReadUint32() (uint32, error) {
 	val, err := br.ReadBits(32)
 	return uint32(val), err
@@ -176,273 +264,825 @@ func (br *BitReader) ReadVarUint16() (uint16, error) {
 	return uint16(first&0x7F) | (uint16(second) << 7), nil
 }
 
+// maxPayload bounds how large a compressed file may inflate.
+const maxPayload = 256 << 20
+
+// Image is everything a bytecode file holds. The VM only needs the code,
+// constants and modules; functions and metadata describe them for tools.
+// Flags records how the file was written and is ignored when writing.
+type Image struct {
+	Instructions []Instruction
+	Constants    []Constant
+	Modules      []ModuleEntry
+	Functions    []FunctionProto
+	Meta         map[string]string
+	Flags        uint8
+}
+
+// FlagNames describes the flags an image was written with.
+func (img *Image) FlagNames() string {
+	var names []string
+	if img.Flags&FlagCompressed != 0 {
+		names = append(names, "compressed")
+	}
+	if img.Flags&FlagStripped != 0 {
+		names = append(names, "stripped")
+	}
+	return strings.Join(names, ", ")
+}
+
+// FunctionProto describes one function body. End is -1 when the body's end
+// is not known.
+type FunctionProto struct {
+	Name   string
+	Entry  int
+	End    int
+	Locals int
+}
+
+// functionTable lists the functions reachable through funcptr constants.
+func functionTable(instructions []Instruction, constants []Constant) []FunctionProto {
+	var protos []FunctionProto
+	for entry, fn := range findFunctions(instructions, constants) {
+		proto := FunctionProto{Name: fn.name, Entry: entry, End: fn.end}
+		if entry < len(instructions) && instructions[entry].Op == OpReserve {
+			proto.Locals = int(toFloat64(instructions[entry].Arg))
+		}
+		protos = append(protos, proto)
+	}
+	sort.Slice(protos, func(i, j int) bool { return protos[i].Entry < protos[j].Entry })
+	return protos
+}
+
+// WriteOptions choose what Write leaves out and how it packs the rest.
+type WriteOptions struct {
+	// Strip drops the line table and function names.
+	Strip bool
+	// Compress deflates everything between the header and the checksum.
+	Compress bool
+}
+
 type BytecodeWriter struct {
-	bitWriter *BitWriter
+	writer  io.Writer
+	Options WriteOptions
 }
 
 func NewBytecodeWriter(w io.Writer) *BytecodeWriter {
-	return &BytecodeWriter{
-		bitWriter: NewBitWriter(w),
-	}
+	return &BytecodeWriter{writer: w}
 }
 
 func (bw *BytecodeWriter) WriteBytecode(instructions []Instruction, constants []Constant) error {
-	if err := bw.bitWriter.WriteUint32(MagicHeader); err != nil {
-		return err
-	}
+	return bw.WriteImage(instructions, constants, nil)
+}
 
-	if err := bw.bitWriter.WriteUint8(VersionCombined); err != nil {
-		return err
+func (bw *BytecodeWriter) WriteImage(instructions []Instruction, constants []Constant, modules []ModuleEntry) error {
+	return bw.Write(&Image{Instructions: instructions, Constants: constants, Modules: modules})
+}
+
+// Write encodes img in the version 4 layout:
+//
+//	magic, version, flags
+//	sections: id byte, varuint length, payload
+//	CRC32 (IEEE) of everything before it
+//
+// Sections come in the order strings, metadata, constants, functions, code,
+// lines and modules. Every string in the file lives once in the string table
+// and is referenced by index. The line and module sections are left out when
+// they would be empty. When img has no function table one is derived from
+// its funcptr constants. The flags byte records whether the sections were
+// compressed and whether debug information was stripped.
+func (bw *BytecodeWriter) Write(img *Image) error {
+	strs := &stringTable{index: make(map[string]int)}
+
+	meta := newSectionWriter(strs)
+	keys := make([]string, 0, len(img.Meta))
+	for key := range img.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	meta.putUint(len(keys))
+	for _, key := range keys {
+		meta.putString(key)
+		meta.putString(img.Meta[key])
 	}
 
-	if err := bw.bitWriter.WriteVarUint(uint32(len(constants))); err != nil {
-		return err
+	consts := newSectionWriter(strs)
+	consts.putUint(len(img.Constants))
+	for _, c := range img.Constants {
+		if err := consts.putConstant(c); err != nil {
+			return err
+		}
 	}
 
-	if err := bw.bitWriter.WriteVarUint(uint32(len(instructions))); err != nil {
-		return err
+	functions := img.Functions
+	if functions == nil {
+		functions = functionTable(img.Instructions, img.Constants)
+	}
+	funcs := newSectionWriter(strs)
+	funcs.putUint(len(functions))
+	for _, fn := range functions {
+		if bw.Options.Strip {
+			fn.Name = ""
+		}
+		funcs.putString(fn.Name)
+		funcs.putUint(fn.Entry)
+		funcs.putUint(fn.End + 1)
+		funcs.putUint(fn.Locals)
 	}
 
-	for _, c := range constants {
-		switch c.Type {
-		case "number":
-			if val, ok := c.Value.(int); ok && val >= -64 && val <= 63 {
-				if err := bw.bitWriter.WriteBits(uint64(ConstTypeNumber), 3); err != nil {
-					return err
-				}
-				if err := bw.bitWriter.WriteBits(1, 1); err != nil {
-					return err
-				}
-				signedVal := int8(val)
-				if err := bw.bitWriter.WriteBits(uint64(signedVal)&0x7F, 7); err != nil {
-					return err
-				}
-			} else {
-				if err := bw.bitWriter.WriteBits(uint64(ConstTypeNumber), 3); err != nil {
-					return err
-				}
-				if err := bw.bitWriter.WriteBits(0, 1); err != nil {
-					return err
-				}
+	code := newSectionWriter(strs)
+	code.putUint(len(img.Instructions))
+	hasLines := false
+	for _, inst := range img.Instructions {
+		if err := code.putInstruction(inst); err != nil {
+			return err
+		}
+		hasLines = hasLines || inst.Line != 0
+	}
 
-				var fval float64
-				if val, ok := c.Value.(float64); ok {
-					fval = val
-				} else if val, ok := c.Value.(int); ok {
-					fval = float64(val)
-				}
+	sections := []section{{SectionMeta, meta}, {SectionConstants, consts}, {SectionFunctions, funcs}, {SectionCode, code}}
 
-				bits := math.Float64bits(fval)
-				for i := 0; i < 64; i++ {
-					bit := (bits >> i) & 1
-					if err := bw.bitWriter.WriteBits(bit, 1); err != nil {
-						return err
-					}
-				}
+	if hasLines && !bw.Options.Strip {
+		lines := newSectionWriter(strs)
+		var runs [][2]int
+		for _, inst := range img.Instructions {
+			if n := len(runs); n > 0 && runs[n-1][1] == inst.Line {
+				runs[n-1][0]++
+				continue
 			}
+			runs = append(runs, [2]int{1, inst.Line})
+		}
+		lines.putUint(len(runs))
+		for _, run := range runs {
+			lines.putUint(run[0])
+			lines.putUint(run[1])
+		}
+		sections = append(sections, section{SectionLines, lines})
+	}
 
-		case "string":
-			str := c.Value.(string)
-			if len(str) <= 255 {
-				if err := bw.bitWriter.WriteBits(uint64(ConstTypeString), 3); err != nil {
-					return err
-				}
-				if err := bw.bitWriter.WriteBits(1, 1); err != nil {
-					return err
-				}
-				if err := bw.bitWriter.WriteBits(uint64(len(str)), 8); err != nil {
-					return err
-				}
-			} else {
-				if err := bw.bitWriter.WriteBits(uint64(ConstTypeString), 3); err != nil {
-					return err
-				}
-				if err := bw.bitWriter.WriteBits(0, 1); err != nil {
-					return err
-				}
-				if err := bw.bitWriter.WriteVarUint(uint32(len(str))); err != nil {
-					return err
-				}
-			}
+	if len(img.Modules) > 0 {
+		mods := newSectionWriter(strs)
+		mods.putUint(len(img.Modules))
+		for _, mod := range img.Modules {
+			mods.putString(mod.Name)
+			mods.putUint(mod.Start)
+			mods.putUint(mod.End)
+		}
+		sections = append(sections, section{SectionModules, mods})
+	}
 
-			for _, ch := range []byte(str) {
-				if err := bw.bitWriter.WriteBits(uint64(ch), 8); err != nil {
-					return err
-				}
-			}
+	table := newSectionWriter(nil)
+	table.putUint(len(strs.list))
+	for _, str := range strs.list {
+		table.putUint(len(str))
+		table.putBytes([]byte(str))
+	}
 
-		case "funcptr":
-			if err := bw.bitWriter.WriteBits(uint64(ConstTypeFuncPtr), 3); err != nil {
-				return err
-			}
-			var val uint32
-			if v, ok := c.Value.(float64); ok {
-				val = uint32(v)
-			} else if v, ok := c.Value.(int); ok {
-				val = uint32(v)
-			}
-			if err := bw.bitWriter.WriteVarUint(val); err != nil {
-				return err
-			}
+	var payload bytes.Buffer
+	sections = append([]section{{SectionStrings, table}}, sections...)
+	for _, sec := range sections {
+		payload.WriteByte(sec.id)
+		payload.Write(binary.AppendUvarint(nil, uint64(len(sec.data.buf))))
+		payload.Write(sec.data.buf)
+	}
 
-		case "bool":
-			if err := bw.bitWriter.WriteBits(uint64(ConstTypeBool), 3); err != nil {
-				return err
-			}
-			var val uint64 = 0
-			if c.Value == true {
-				val = 1
+	var flags uint8
+	if bw.Options.Strip {
+		flags |= FlagStripped
+	}
+	var out bytes.Buffer
+	out.Write(binary.LittleEndian.AppendUint32(nil, MagicHeader))
+	out.WriteByte(VersionCombined)
+	if bw.Options.Compress {
+		out.WriteByte(flags | FlagCompressed)
+		zw, err := flate.NewWriter(&out, flate.BestCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(payload.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else {
+		out.WriteByte(flags)
+		out.Write(payload.Bytes())
+	}
+	out.Write(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(out.Bytes())))
+
+	_, err := bw.writer.Write(out.Bytes())
+	return err
+}
+
+type section struct {
+	id   uint8
+	data *sectionWriter
+}
+
+type stringTable struct {
+	list  []string
+	index map[string]int
+}
+
+func (t *stringTable) add(s string) int {
+	if idx, ok := t.index[s]; ok {
+		return idx
+	}
+	t.index[s] = len(t.list)
+	t.list = append(t.list, s)
+	return len(t.list) - 1
+}
+
+// sectionWriter encodes one section in memory. Version 4 sections are byte
+// aligned, so values are appended whole instead of going through a
+// BitWriter: varuints and zigzag varints as in version 3, floats as eight
+// little endian bytes.
+type sectionWriter struct {
+	buf     []byte
+	strings *stringTable
+}
+
+func newSectionWriter(strs *stringTable) *sectionWriter {
+	return &sectionWriter{strings: strs}
+}
+
+func (sw *sectionWriter) putByte(b uint8) {
+	sw.buf = append(sw.buf, b)
+}
+
+func (sw *sectionWriter) putBytes(data []byte) {
+	sw.buf = append(sw.buf, data...)
+}
+
+func (sw *sectionWriter) putUint(val int) {
+	sw.buf = binary.AppendUvarint(sw.buf, uint64(uint32(val)))
+}
+
+func (sw *sectionWriter) putInt(val int32) {
+	sw.buf = binary.AppendVarint(sw.buf, int64(val))
+}
+
+func (sw *sectionWriter) putFloat(val float64) {
+	sw.buf = binary.LittleEndian.AppendUint64(sw.buf, math.Float64bits(val))
+}
+
+func (sw *sectionWriter) putString(s string) {
+	sw.putUint(sw.strings.add(s))
+}
+
+// putConstant writes a tag byte, the constant type in the low nibble and its
+// flags in the high one, followed by the value. Whole numbers that fit an
+// int32 are stored as varints.
+func (sw *sectionWriter) putConstant(c Constant) error {
+	switch c.Type {
+	case "number":
+		val := toFloat64(c.Value)
+		if val == float64(int32(val)) && !(val == 0 && math.Signbit(val)) {
+			sw.putByte(ConstTypeNumber | ConstFlagSmallInt<<4)
+			sw.putInt(int32(val))
+			return nil
+		}
+		sw.putByte(ConstTypeNumber)
+		sw.putFloat(val)
+	case "string":
+		sw.putByte(ConstTypeString)
+		sw.putString(c.Value.(string))
+	case "funcptr":
+		sw.putByte(ConstTypeFuncPtr)
+		sw.putUint(int(toFloat64(c.Value)))
+	case "bool":
+		sw.putByte(ConstTypeBool)
+		if c.Value == true {
+			sw.putByte(1)
+		} else {
+			sw.putByte(0)
+		}
+	case "nil":
+		sw.putByte(ConstTypeNil)
+	default:
+		return fmt.Errorf("cannot encode %s constant", c.Type)
+	}
+	return nil
+}
+
+func (sw *sectionWriter) putInstruction(inst Instruction) error {
+	opcode := uint8(inst.Op) & 0x7F
+	if inst.Arg == nil {
+		sw.putByte(opcode)
+		return nil
+	}
+	sw.putByte(opcode | 0x80)
+
+	switch arg := inst.Arg.(type) {
+	case float64:
+		if arg == float64(int32(arg)) {
+			sw.putByte(ArgTypeInt)
+			sw.putInt(int32(arg))
+		} else {
+			sw.putByte(ArgTypeFloat)
+			sw.putFloat(arg)
+		}
+	case int:
+		sw.putByte(ArgTypeInt)
+		sw.putInt(int32(arg))
+	case string:
+		sw.putByte(ArgTypeString)
+		sw.putString(arg)
+	default:
+		return fmt.Errorf("cannot encode %T argument of %s", inst.Arg, inst.Op)
+	}
+	return nil
+}
+
+type BytecodeReader struct {
+	reader io.Reader
+}
+
+func NewBytecodeReader(r io.Reader) *BytecodeReader {
+	return &BytecodeReader{reader: r}
+}
+
+func (br *BytecodeReader) ReadBytecode() ([]Instruction, []Constant, error) {
+	instructions, constants, _, err := br.ReadImage()
+	return instructions, constants, err
+}
+
+func (br *BytecodeReader) ReadImage() ([]Instruction, []Constant, []ModuleEntry, error) {
+	img, err := br.Read()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return img.Instructions, img.Constants, img.Modules, nil
+}
+
+// Read decodes a version 4 file, or a version 3 one which only carries code,
+// constants and, from 3.1 on, a module table.
+func (br *BytecodeReader) Read() (*Image, error) {
+	data, err := io.ReadAll(br.reader)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// decode reads an image from the whole of a file's contents.
+func decode(data []byte) (*Image, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("invalid bytecode file: too short")
+	}
+	if binary.LittleEndian.Uint32(data) != MagicHeader {
+		return nil, fmt.Errorf("invalid bytecode file: bad magic")
+	}
+
+	major := data[4] >> 4
+	minor := data[4] & 0x0F
+	switch major {
+	case VersionMajor:
+		return readV4(data)
+	case 3:
+		return readV3(data, minor)
+	}
+	return nil, fmt.Errorf("incompatible bytecode version: %d.%d", major, minor)
+}
+
+func readV4(data []byte) (*Image, error) {
+	if len(data) < 10 {
+		return nil, fmt.Errorf("invalid bytecode file: too short")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, fmt.Errorf("invalid bytecode file: checksum mismatch")
+	}
+	flags := body[5]
+	if flags&^(FlagCompressed|FlagStripped) != 0 {
+		return nil, fmt.Errorf("invalid bytecode file: unknown flags %#x", flags)
+	}
+
+	body = body[6:]
+	if flags&FlagCompressed != 0 {
+		zr := flate.NewReader(bytes.NewReader(body))
+		inflated, err := io.ReadAll(io.LimitReader(zr, maxPayload+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytecode file: %v", err)
+		}
+		if len(inflated) > maxPayload {
+			return nil, fmt.Errorf("invalid bytecode file: sections inflate past %d MB", maxPayload>>20)
+		}
+		body = inflated
+	}
+
+	img := &Image{Flags: flags}
+	var strs []string
+	var boxed []interface{}
+	haveCode := false
+	for pos := 0; pos < len(body); {
+		id := body[pos]
+		size, n := binary.Uvarint(body[pos+1:])
+		if n <= 0 || size > uint64(len(body)-pos-1-n) {
+			return nil, fmt.Errorf("invalid bytecode file: section %d is truncated", id)
+		}
+		pos += 1 + n
+		sr := newSectionReader(body[pos:pos+int(size)], strs, boxed)
+		pos += int(size)
+
+		var err error
+		switch id {
+		case SectionStrings:
+			if strs, err = sr.stringTable(); err == nil {
+				boxed = make([]interface{}, len(strs))
+				for i, str := range strs {
+					boxed[i] = str
+				}
 			}
-			if err := bw.bitWriter.WriteBits(val, 1); err != nil {
-				return err
+		case SectionMeta:
+			img.Meta, err = sr.meta()
+		case SectionConstants:
+			img.Constants, err = sr.constants()
+		case SectionFunctions:
+			img.Functions, err = sr.functions()
+		case SectionCode:
+			img.Instructions, err = sr.code()
+			haveCode = true
+		case SectionLines:
+			if !haveCode {
+				return nil, fmt.Errorf("invalid bytecode file: line table before code")
 			}
+			err = sr.lines(img.Instructions)
+		case SectionModules:
+			img.Modules, err = sr.modules()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytecode file: section %d: %v", id, err)
+		}
+	}
+	return img, nil
+}
 
-		case "nil":
-			if err := bw.bitWriter.WriteBits(uint64(ConstTypeNil), 3); err != nil {
-				return err
-			}
+// smallArgs holds the boxed slot numbers, counts and addresses most
+// instructions carry, so decoding them does not allocate.
+var smallArgs = func() []interface{} {
+	args := make([]interface{}, 1024)
+	for i := range args {
+		args[i] = float64(i)
+	}
+	return args
+}()
+
+// sectionReader decodes one section of a version 4 file straight from
+// memory, reading floats a whole word at a time.
+type sectionReader struct {
+	data    []byte
+	pos     int
+	strings []string
+	boxed   []interface{}
+}
+
+func newSectionReader(data []byte, strs []string, boxed []interface{}) *sectionReader {
+	return &sectionReader{data: data, strings: strs, boxed: boxed}
+}
+
+func (sr *sectionReader) readByte() (uint8, error) {
+	if sr.pos >= len(sr.data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := sr.data[sr.pos]
+	sr.pos++
+	return b, nil
+}
+
+func (sr *sectionReader) readUint() (int, error) {
+	val, n := binary.Uvarint(sr.data[sr.pos:])
+	if n <= 0 || val > math.MaxUint32 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	sr.pos += n
+	return int(val), nil
+}
+
+// count reads the length of a list, which can never exceed the bytes left
+// in the section since every entry takes at least one.
+func (sr *sectionReader) count() (int, error) {
+	n, err := sr.readUint()
+	if err == nil && n > len(sr.data)-sr.pos {
+		err = fmt.Errorf("count %d larger than the section", n)
+	}
+	return n, err
+}
+
+func (sr *sectionReader) readInt() (int32, error) {
+	val, n := binary.Varint(sr.data[sr.pos:])
+	if n <= 0 || val != int64(int32(val)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	sr.pos += n
+	return int32(val), nil
+}
+
+func (sr *sectionReader) readFloat() (float64, error) {
+	if len(sr.data)-sr.pos < 8 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	bits := binary.LittleEndian.Uint64(sr.data[sr.pos:])
+	sr.pos += 8
+	return math.Float64frombits(bits), nil
+}
+
+func (sr *sectionReader) readIndex() (int, error) {
+	idx, err := sr.readUint()
+	if err == nil && idx >= len(sr.strings) {
+		err = fmt.Errorf("string %d not in the string table", idx)
+	}
+	return idx, err
+}
+
+func (sr *sectionReader) readString() (string, error) {
+	idx, err := sr.readIndex()
+	if err != nil {
+		return "", err
+	}
+	return sr.strings[idx], nil
+}
+
+func (sr *sectionReader) stringTable() ([]string, error) {
+	n, err := sr.count()
+	if err != nil {
+		return nil, err
+	}
+	// The strings share one copy of the section rather than taking one each.
+	all := string(sr.data)
+	strs := make([]string, n)
+	for i := range strs {
+		size, err := sr.count()
+		if err != nil {
+			return nil, err
 		}
+		strs[i] = all[sr.pos : sr.pos+size]
+		sr.pos += size
 	}
+	return strs, nil
+}
 
-	for _, inst := range instructions {
-		opcode := uint64(inst.Op) & 0x7F
-		hasArg := inst.Arg != nil
-		if hasArg {
-			opcode |= 0x80
+func (sr *sectionReader) meta() (map[string]string, error) {
+	n, err := sr.count()
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		key, err := sr.readString()
+		if err != nil {
+			return nil, err
 		}
-		if err := bw.bitWriter.WriteBits(opcode, 8); err != nil {
-			return err
+		if meta[key], err = sr.readString(); err != nil {
+			return nil, err
 		}
+	}
+	return meta, nil
+}
 
-		if err := bw.bitWriter.WriteVarUint16(uint16(inst.Line)); err != nil {
-			return err
+func (sr *sectionReader) constants() ([]Constant, error) {
+	n, err := sr.count()
+	if err != nil {
+		return nil, err
+	}
+	constants := make([]Constant, n)
+	for i := range constants {
+		tag, err := sr.readByte()
+		if err != nil {
+			return nil, err
 		}
 
-		if hasArg {
-			var argType uint64
-
-			switch arg := inst.Arg.(type) {
-			case float64:
-				if arg == float64(int32(arg)) {
-					argType = ArgTypeInt
-					val := int32(arg)
-					if err := bw.bitWriter.WriteBits(argType, 2); err != nil {
-						return err
-					}
-					if err := bw.bitWriter.WriteVarInt(val); err != nil {
-						return err
-					}
+		switch tag & 0x0F {
+		case ConstTypeNumber:
+			if tag>>4&ConstFlagSmallInt != 0 {
+				var small int32
+				if small, err = sr.readInt(); small >= 0 && int(small) < len(smallArgs) {
+					constants[i] = Constant{Value: smallArgs[small], Type: "number"}
 				} else {
-					argType = ArgTypeFloat
-					if err := bw.bitWriter.WriteBits(argType, 2); err != nil {
-						return err
-					}
-					bits := math.Float64bits(arg)
-					for i := 0; i < 64; i++ {
-						bit := (bits >> i) & 1
-						if err := bw.bitWriter.WriteBits(bit, 1); err != nil {
-							return err
-						}
-					}
+					constants[i] = Constant{Value: float64(small), Type: "number"}
 				}
-				continue
+			} else {
+				var val float64
+				val, err = sr.readFloat()
+				constants[i] = Constant{Value: val, Type: "number"}
+			}
+		case ConstTypeString:
+			var idx int
+			if idx, err = sr.readIndex(); err == nil {
+				constants[i] = Constant{Value: sr.boxed[idx], Type: "string"}
+			}
+		case ConstTypeFuncPtr:
+			var entry int
+			entry, err = sr.readUint()
+			constants[i] = Constant{Value: float64(entry), Type: "funcptr"}
+		case ConstTypeBool:
+			var b uint8
+			b, err = sr.readByte()
+			constants[i] = Constant{Value: b == 1, Type: "bool"}
+		case ConstTypeNil:
+			constants[i] = Constant{Value: nil, Type: "nil"}
+		default:
+			return nil, fmt.Errorf("unknown constant type %d", tag&0x0F)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return constants, nil
+}
 
-			case int:
-				argType = ArgTypeInt
-				if err := bw.bitWriter.WriteBits(argType, 2); err != nil {
-					return err
-				}
-				if err := bw.bitWriter.WriteVarInt(int32(arg)); err != nil {
-					return err
-				}
-				continue
+func (sr *sectionReader) functions() ([]FunctionProto, error) {
+	n, err := sr.count()
+	if err != nil {
+		return nil, err
+	}
+	protos := make([]FunctionProto, n)
+	for i := range protos {
+		fn := &protos[i]
+		if fn.Name, err = sr.readString(); err != nil {
+			return nil, err
+		}
+		if fn.Entry, err = sr.readUint(); err != nil {
+			return nil, err
+		}
+		if fn.End, err = sr.readUint(); err != nil {
+			return nil, err
+		}
+		fn.End--
+		if fn.Locals, err = sr.readUint(); err != nil {
+			return nil, err
+		}
+	}
+	return protos, nil
+}
 
-			case string:
-				argType = ArgTypeString
-				if err := bw.bitWriter.WriteBits(argType, 2); err != nil {
-					return err
-				}
-				if err := bw.bitWriter.WriteVarUint(uint32(len(arg))); err != nil {
-					return err
-				}
-				for _, ch := range []byte(arg) {
-					if err := bw.bitWriter.WriteBits(uint64(ch), 8); err != nil {
-						return err
-					}
-				}
-				continue
+func (sr *sectionReader) code() ([]Instruction, error) {
+	n, err := sr.count()
+	if err != nil {
+		return nil, err
+	}
+	instructions := make([]Instruction, n)
+	for i := range instructions {
+		opcode, err := sr.readByte()
+		if err != nil {
+			return nil, err
+		}
+		instructions[i].Op = OpCode(opcode & 0x7F)
+		if opcode&0x80 == 0 {
+			continue
+		}
 
-			default:
-				if f, ok := arg.(float64); ok {
-					argType = ArgTypeConst
-					if err := bw.bitWriter.WriteBits(argType, 2); err != nil {
-						return err
-					}
-					if err := bw.bitWriter.WriteVarUint(uint32(f)); err != nil {
-						return err
-					}
-				}
+		argType, err := sr.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch argType {
+		case ArgTypeInt:
+			var val int32
+			if val, err = sr.readInt(); val >= 0 && int(val) < len(smallArgs) {
+				instructions[i].Arg = smallArgs[val]
+			} else {
+				instructions[i].Arg = float64(val)
 			}
+		case ArgTypeFloat:
+			instructions[i].Arg, err = sr.readFloat()
+		case ArgTypeString:
+			var idx int
+			if idx, err = sr.readIndex(); err == nil {
+				instructions[i].Arg = sr.boxed[idx]
+			}
+		default:
+			return nil, fmt.Errorf("unknown argument type %d", argType)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	return bw.bitWriter.Flush()
+	return instructions, nil
 }
 
-type BytecodeReader struct {
-	bitReader *BitReader
+func (sr *sectionReader) lines(instructions []Instruction) error {
+	runs, err := sr.count()
+	if err != nil {
+		return err
+	}
+	ip := 0
+	for i := 0; i < runs; i++ {
+		count, err := sr.readUint()
+		if err != nil {
+			return err
+		}
+		line, err := sr.readUint()
+		if err != nil {
+			return err
+		}
+		if count > len(instructions)-ip {
+			return fmt.Errorf("line table covers more than %d instructions", len(instructions))
+		}
+		for ; count > 0; count-- {
+			instructions[ip].Line = line
+			ip++
+		}
+	}
+	return nil
 }
 
-func NewBytecodeReader(r io.Reader) *BytecodeReader {
-	return &BytecodeReader{
-		bitReader: NewBitReader(r),
+func (sr *sectionReader) modules() ([]ModuleEntry, error) {
+	n, err := sr.count()
+	if err != nil {
+		return nil, err
 	}
+	modules := make([]ModuleEntry, n)
+	for i := range modules {
+		mod := &modules[i]
+		if mod.Name, err = sr.readString(); err != nil {
+			return nil, err
+		}
+		if mod.Start, err = sr.readUint(); err != nil {
+			return nil, err
+		}
+		if mod.End, err = sr.readUint(); err != nil {
+			return nil, err
+		}
+	}
+	return modules, nil
 }
 
-func (br *BytecodeReader) ReadBytecode() ([]Instruction, []Constant, error) {
-	magic, err := br.bitReader.ReadUint32()
+// readV3 decodes the bit packed version 3 layout: header, constant and
+// instruction counts, constants, instructions and, from 3.1 on, the module
+// table.
+func readV3(data []byte, minor uint8) (*Image, error) {
+	br := NewBitReader(bytes.NewReader(data[5:]))
+	instructions, constants, err := readV3Code(br, len(data))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	if magic != MagicHeader {
-		return nil, nil, fmt.Errorf("invalid bytecode file: bad magic")
+	img := &Image{Instructions: instructions, Constants: constants}
+	if minor < 1 {
+		return img, nil
 	}
 
-	version, err := br.bitReader.ReadUint8()
+	moduleCount, err := br.ReadVarUint()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	major := version >> 4
-	minor := version & 0x0F
-	if major != VersionMajor {
-		return nil, nil, fmt.Errorf("incompatible bytecode version: %d.%d", major, minor)
+	if int(moduleCount) > len(data) {
+		return nil, fmt.Errorf("invalid bytecode file: truncated")
 	}
+	modules := make([]ModuleEntry, moduleCount)
+	for i := range modules {
+		nameLen, err := br.ReadVarUint()
+		if err != nil {
+			return nil, err
+		}
+		nameBytes := make([]byte, nameLen)
+		if err := br.ReadBytes(nameBytes); err != nil {
+			return nil, err
+		}
+		start, err := br.ReadVarUint()
+		if err != nil {
+			return nil, err
+		}
+		end, err := br.ReadVarUint()
+		if err != nil {
+			return nil, err
+		}
+		modules[i] = ModuleEntry{Name: string(nameBytes), Start: int(start), End: int(end)}
+	}
+	img.Modules = modules
+	return img, nil
+}
 
-	constantCount, err := br.bitReader.ReadVarUint()
+func readV3Code(br *BitReader, size int) ([]Instruction, []Constant, error) {
+	constantCount, err := br.ReadVarUint()
 	if err != nil {
 		return nil, nil, err
 	}
-	instructionCount, err := br.bitReader.ReadVarUint()
+	instructionCount, err := br.ReadVarUint()
 	if err != nil {
 		return nil, nil, err
 	}
+	if int(constantCount) > size || int(instructionCount) > size {
+		return nil, nil, fmt.Errorf("invalid bytecode file: truncated")
+	}
 
 	constants := make([]Constant, constantCount)
 	for i := range constants {
-		constType, err := br.bitReader.ReadBits(3)
+		constType, err := br.ReadBits(3)
 		if err != nil {
 			return nil, nil, err
 		}
 
 		switch uint8(constType) {
 		case ConstTypeNumber:
-			isSmall, err := br.bitReader.ReadBits(1)
+			isSmall, err := br.ReadBits(1)
 			if err != nil {
 				return nil, nil, err
 			}
 
 			if isSmall == 1 {
-				valBits, err := br.bitReader.ReadBits(7)
+				valBits, err := br.ReadBits(7)
 				if err != nil {
 					return nil, nil, err
 				}
@@ -452,57 +1092,49 @@ func (br *BytecodeReader) ReadBytecode() ([]Instruction, []Constant, error) {
 				}
 				constants[i] = Constant{Value: int(val), Type: "number"}
 			} else {
-				var bits uint64
-				for i := 0; i < 64; i++ {
-					bit, err := br.bitReader.ReadBits(1)
-					if err != nil {
-						return nil, nil, err
-					}
-					bits |= bit << i
+				bits, err := br.ReadBits(64)
+				if err != nil {
+					return nil, nil, err
 				}
 				val := math.Float64frombits(bits)
 				constants[i] = Constant{Value: val, Type: "number"}
 			}
 
 		case ConstTypeString:
-			isShort, err := br.bitReader.ReadBits(1)
+			isShort, err := br.ReadBits(1)
 			if err != nil {
 				return nil, nil, err
 			}
 
 			var strLen uint32
 			if isShort == 1 {
-				lenBits, err := br.bitReader.ReadBits(8)
+				lenBits, err := br.ReadBits(8)
 				if err != nil {
 					return nil, nil, err
 				}
 				strLen = uint32(lenBits)
 			} else {
-				strLen, err = br.bitReader.ReadVarUint()
+				strLen, err = br.ReadVarUint()
 				if err != nil {
 					return nil, nil, err
 				}
 			}
 
 			strBytes := make([]byte, strLen)
-			for j := range strBytes {
-				ch, err := br.bitReader.ReadBits(8)
-				if err != nil {
-					return nil, nil, err
-				}
-				strBytes[j] = byte(ch)
+			if err := br.ReadBytes(strBytes); err != nil {
+				return nil, nil, err
 			}
 			constants[i] = Constant{Value: string(strBytes), Type: "string"}
 
 		case ConstTypeFuncPtr:
-			val, err := br.bitReader.ReadVarUint()
+			val, err := br.ReadVarUint()
 			if err != nil {
 				return nil, nil, err
 			}
 			constants[i] = Constant{Value: float64(val), Type: "funcptr"}
 
 		case ConstTypeBool:
-			val, err := br.bitReader.ReadBits(1)
+			val, err := br.ReadBits(1)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -515,7 +1147,7 @@ func (br *BytecodeReader) ReadBytecode() ([]Instruction, []Constant, error) {
 
 	instructions := make([]Instruction, instructionCount)
 	for i := range instructions {
-		opcode, err := br.bitReader.ReadBits(8)
+		opcode, err := br.ReadBits(8)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -523,28 +1155,28 @@ func (br *BytecodeReader) ReadBytecode() ([]Instruction, []Constant, error) {
 		hasArg := (opcode & 0x80) != 0
 		opcode &^= 0x80
 
-		line, err := br.bitReader.ReadVarUint16()
+		line, err := br.ReadVarUint16()
 		if err != nil {
 			return nil, nil, err
 		}
 
 		var arg interface{}
 		if hasArg {
-			argType, err := br.bitReader.ReadBits(2)
+			argType, err := br.ReadBits(2)
 			if err != nil {
 				return nil, nil, err
 			}
 
 			switch argType {
 			case ArgTypeConst:
-				idx, err := br.bitReader.ReadVarUint()
+				idx, err := br.ReadVarUint()
 				if err != nil {
 					return nil, nil, err
 				}
 				arg = float64(idx)
 
 			case ArgTypeInt:
-				uval, err := br.bitReader.ReadVarUint()
+				uval, err := br.ReadVarUint()
 				if err != nil {
 					return nil, nil, err
 				}
@@ -555,28 +1187,20 @@ func (br *BytecodeReader) ReadBytecode() ([]Instruction, []Constant, error) {
 				arg = float64(val)
 
 			case ArgTypeFloat:
-				var bits uint64
-				for i := 0; i < 64; i++ {
-					bit, err := br.bitReader.ReadBits(1)
-					if err != nil {
-						return nil, nil, err
-					}
-					bits |= bit << i
+				bits, err := br.ReadBits(64)
+				if err != nil {
+					return nil, nil, err
 				}
 				arg = math.Float64frombits(bits)
 
 			case ArgTypeString:
-				strLen, err := br.bitReader.ReadVarUint()
+				strLen, err := br.ReadVarUint()
 				if err != nil {
 					return nil, nil, err
 				}
 				strBytes := make([]byte, strLen)
-				for j := range strBytes {
-					ch, err := br.bitReader.ReadBits(8)
-					if err != nil {
-						return nil, nil, err
-					}
-					strBytes[j] = byte(ch)
+				if err := br.ReadBytes(strBytes); err != nil {
+					return nil, nil, err
 				}
 				arg = string(strBytes)
 			}
@@ -593,6 +1217,14 @@ func (br *BytecodeReader) ReadBytecode() ([]Instruction, []Constant, error) {
 }
 
 func SaveBytecode(filename string, instructions []Instruction, constants []Constant) error {
+	return SaveImage(filename, instructions, constants, nil)
+}
+
+func SaveImage(filename string, instructions []Instruction, constants []Constant, modules []ModuleEntry) error {
+	return SaveFile(filename, &Image{Instructions: instructions, Constants: constants, Modules: modules}, WriteOptions{})
+}
+
+func SaveFile(filename string, img *Image, opts WriteOptions) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
@@ -600,16 +1232,28 @@ func SaveBytecode(filename string, instructions []Instruction, constants []Const
 	defer file.Close()
 
 	writer := NewBytecodeWriter(file)
-	return writer.WriteBytecode(instructions, constants)
+	writer.Options = opts
+	return writer.Write(img)
 }
 
 func LoadBytecode(filename string) ([]Instruction, []Constant, error) {
-	file, err := os.Open(filename)
+	instructions, constants, _, err := LoadImage(filename)
+	return instructions, constants, err
+}
+
+func LoadImage(filename string) ([]Instruction, []Constant, []ModuleEntry, error) {
+	img, err := LoadFile(filename)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	return img.Instructions, img.Constants, img.Modules, nil
+}
+
+func LoadFile(filename string) (*Image, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
 	}
-	defer file.Close()
 
-	reader := NewBytecodeReader(file)
-	return reader.ReadBytecode()
+	return decode(data)
 }
@@ -0,0 +1,171 @@
+package main
+
+// The optimizer works on basic blocks, runs of instructions that control only
+// enters at the top. While the code is in blocks, the argument of a jump or
+// try and the entry of a funcptr constant are labels naming a block instead
+// of instruction indexes, so a pass can add or drop instructions anywhere
+// without moving what points at them. linearize lays the blocks back out and
+// turns the labels into indexes again.
+
+// label is a block's position in Optimizer.blocks. Blocks are never removed
+// while the code is in blocks, a dead one just has its code emptied.
+type label int
+
+type block struct {
+	code []Instruction
+}
+
+// endsBlock reports whether control never goes on to the instruction after
+// op, or not always.
+func endsBlock(op OpCode) bool {
+	switch op {
+	case OpJump, OpJumpIfFalse, OpReturn, OpHalt, OpThrow:
+		return true
+	}
+	return false
+}
+
+// buildBlocks splits o.Instructions into blocks. The last block is always
+// empty and stands for the end of the code, which jumps may target.
+func (o *Optimizer) buildBlocks() {
+	n := len(o.Instructions)
+	leader := make([]bool, n+1)
+	leader[0], leader[n] = true, true
+	mark := func(target int) {
+		if target >= 0 && target <= n {
+			leader[target] = true
+		}
+	}
+	for i, inst := range o.Instructions {
+		if isJump(inst.Op) {
+			mark(int(toFloat64(inst.Arg)))
+		}
+		if endsBlock(inst.Op) {
+			leader[i+1] = true
+		}
+	}
+	for _, c := range o.Constants {
+		if c.Type == "funcptr" {
+			mark(int(toFloat64(c.Value)))
+		}
+	}
+
+	labels := make([]label, n+1)
+	o.blocks = o.blocks[:0]
+	for i := 0; i <= n; i++ {
+		if leader[i] {
+			o.blocks = append(o.blocks, &block{})
+		}
+		labels[i] = label(len(o.blocks) - 1)
+	}
+	// A target outside the code keeps its number, the verifier reports it.
+	for i, inst := range o.Instructions {
+		if isJump(inst.Op) {
+			if target := int(toFloat64(inst.Arg)); target >= 0 && target <= n {
+				inst.Arg = labels[target]
+			}
+		}
+		b := o.blocks[labels[i]]
+		b.code = append(b.code, inst)
+	}
+	for i, c := range o.Constants {
+		if c.Type == "funcptr" {
+			if entry := int(toFloat64(c.Value)); entry >= 0 && entry <= n {
+				o.Constants[i].Value = labels[entry]
+			}
+		}
+	}
+	o.Instructions = nil
+}
+
+// linearize lays the blocks out in order. With dropJumps set it leaves out
+// jumps to the block right after them and returns how many. A dead block's
+// label resolves to where the next live block starts.
+func (o *Optimizer) linearize(dropJumps bool) int {
+	dropped := 0
+	for i, b := range o.blocks {
+		if !dropJumps || len(b.code) == 0 {
+			continue
+		}
+		last := b.code[len(b.code)-1]
+		target, ok := last.Arg.(label)
+		if last.Op != OpJump || !ok {
+			continue
+		}
+		for next := i + 1; next < len(o.blocks); next++ {
+			if label(next) == target {
+				b.code = b.code[:len(b.code)-1]
+				dropped++
+				break
+			}
+			if len(o.blocks[next].code) > 0 {
+				break
+			}
+		}
+	}
+
+	start := make([]int, len(o.blocks))
+	n := 0
+	for i, b := range o.blocks {
+		start[i] = n
+		n += len(b.code)
+	}
+	out := make([]Instruction, 0, n)
+	for _, b := range o.blocks {
+		for _, inst := range b.code {
+			if target, ok := inst.Arg.(label); ok {
+				inst.Arg = float64(start[target])
+			}
+			out = append(out, inst)
+		}
+	}
+	for i, c := range o.Constants {
+		if entry, ok := c.Value.(label); ok {
+			o.Constants[i].Value = float64(start[entry])
+		}
+	}
+	o.Instructions, o.blocks = out, o.blocks[:0]
+	return dropped
+}
+
+// edges lists the blocks control goes to from b, which sits at l, by
+// jumping or falling through, the ways that stay in the same frame.
+func (o *Optimizer) edges(l label, b *block) []label {
+	var out []label
+	falls := true
+	for _, inst := range b.code {
+		switch inst.Op {
+		case OpJump, OpJumpIfFalse:
+			if target, ok := inst.Arg.(label); ok {
+				out = append(out, target)
+			}
+		}
+		switch inst.Op {
+		case OpJump, OpReturn, OpHalt, OpThrow:
+			falls = false
+		}
+	}
+	if falls && int(l)+1 < len(o.blocks) {
+		out = append(out, l+1)
+	}
+	return out
+}
+
+// successors is edges plus the entries of the functions b makes and the
+// catch blocks of the try blocks it opens.
+func (o *Optimizer) successors(l label, b *block) []label {
+	out := o.edges(l, b)
+	for _, inst := range b.code {
+		switch inst.Op {
+		case OpTry:
+			if target, ok := inst.Arg.(label); ok {
+				out = append(out, target)
+			}
+		case OpMakeFunc:
+			if entry, ok := o.Constants[int(toFloat64(inst.Arg))].Value.(label); ok {
+				out = append(out, entry)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,272 @@
+package main
+
+// Constant propagation. Reads of a local that holds the same constant on
+// every path to them, and of a global the unit only ever sets to one
+// constant, become that constant, which lets folding and branch folding take
+// it from there.
+
+// slotConsts maps a local slot to the constant index it is known to hold.
+type slotConsts map[int]int
+
+// meet keeps the slots a and b agree on.
+func (a slotConsts) meet(b slotConsts) slotConsts {
+	out := make(slotConsts)
+	for slot, c := range a {
+		if bc, ok := b[slot]; ok && bc == c {
+			out[slot] = c
+		}
+	}
+	return out
+}
+
+func (a slotConsts) equal(b slotConsts) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for slot, c := range a {
+		if bc, ok := b[slot]; !ok || bc != c {
+			return false
+		}
+	}
+	return true
+}
+
+// doConstantPropagation returns how many reads it replaced.
+func (o *Optimizer) doConstantPropagation() int {
+	return o.propagateLocals() + o.propagateGlobals()
+}
+
+// propagableConst reports the constant index inst pushes, if it pushes one
+// propagation may copy.
+func (o *Optimizer) propagableConst(inst Instruction) (int, bool) {
+	if inst.Op != OpConstant {
+		return 0, false
+	}
+	idx := int(toFloat64(inst.Arg))
+	if idx < 0 || idx >= len(o.Constants) || o.Constants[idx].Type == "funcptr" {
+		return 0, false
+	}
+	return idx, true
+}
+
+// stepLocals runs the instructions of b over the slots known on entry. It
+// tracks which values near the top of the stack are constants, so a store
+// from anywhere on the stack is followed. With rewrite set, reads of known
+// slots are replaced and counted.
+func (o *Optimizer) stepLocals(b *block, known slotConsts, rewrite bool) (slotConsts, int) {
+	out := make(slotConsts, len(known))
+	for slot, c := range known {
+		out[slot] = c
+	}
+
+	// stack holds a constant index for each value pushed in this block, or
+	// -1 for one that isn't known. Values pushed before the block aren't in
+	// it and count as unknown.
+	var stack []int
+	replaced := 0
+	for i := range b.code {
+		inst := b.code[i]
+		switch inst.Op {
+		case OpGetLocal:
+			if c, ok := out[int(toFloat64(inst.Arg))]; ok {
+				if rewrite {
+					b.code[i] = Instruction{Op: OpConstant, Arg: float64(c), Line: inst.Line}
+					replaced++
+				}
+				stack = append(stack, c)
+				continue
+			}
+		case OpSetLocal:
+			slot := int(toFloat64(inst.Arg))
+			if n := len(stack); n > 0 && stack[n-1] >= 0 {
+				out[slot] = stack[n-1]
+			} else {
+				delete(out, slot)
+			}
+		case OpConstant:
+			if c, ok := o.propagableConst(inst); ok {
+				stack = append(stack, c)
+				continue
+			}
+		}
+
+		count, ok := 0, true
+		switch inst.Op {
+		case OpCall, OpTailCall, OpCallIndirect, OpCallMethod:
+			count, ok = o.callCount(b.code, i)
+		}
+		if !ok {
+			// Without the count there's no telling how deep the stack is.
+			stack = append(stack[:0], -1)
+			continue
+		}
+		pops, pushes := stackEffect(inst, count)
+		if pops > len(stack) {
+			pops = len(stack)
+		}
+		stack = stack[:len(stack)-pops]
+		for ; pushes > 0; pushes-- {
+			stack = append(stack, -1)
+		}
+	}
+	return out, replaced
+}
+
+// callCount reads the argument count in front of the call at code[i].
+func (o *Optimizer) callCount(code []Instruction, i int) (int, bool) {
+	if i == 0 || code[i-1].Op != OpConstant {
+		return 0, false
+	}
+	c := o.Constants[int(toFloat64(code[i-1].Arg))]
+	if c.Type != "number" {
+		return 0, false
+	}
+	return int(toFloat64(c.Value)), true
+}
+
+// propagateLocals finds the slots known on entry to every block and rewrites
+// the reads. Frames don't share locals, so the start of the unit, function
+// entries and catch blocks all begin knowing nothing.
+func (o *Optimizer) propagateLocals() int {
+	roots := make([]bool, len(o.blocks))
+	roots[0] = true
+	for _, c := range o.Constants {
+		if entry, ok := c.Value.(label); ok {
+			roots[entry] = true
+		}
+	}
+	for _, b := range o.blocks {
+		for _, inst := range b.code {
+			if target, ok := inst.Arg.(label); ok && inst.Op == OpTry {
+				roots[target] = true
+			}
+		}
+	}
+
+	in := make([]slotConsts, len(o.blocks))
+	var work []label
+	for i, root := range roots {
+		if root {
+			in[i] = slotConsts{}
+			work = append(work, label(i))
+		}
+	}
+	for len(work) > 0 {
+		l := work[len(work)-1]
+		work = work[:len(work)-1]
+		out, _ := o.stepLocals(o.blocks[l], in[l], false)
+		for _, next := range o.edges(l, o.blocks[l]) {
+			merged := out
+			if in[next] != nil {
+				merged = in[next].meet(out)
+				if merged.equal(in[next]) {
+					continue
+				}
+			}
+			in[next] = merged
+			work = append(work, next)
+		}
+	}
+
+	replaced := 0
+	for i, b := range o.blocks {
+		if in[i] != nil {
+			_, n := o.stepLocals(b, in[i], true)
+			replaced += n
+		}
+	}
+	return replaced
+}
+
+// propagateGlobals replaces reads of globals the unit sets exactly once, to
+// a constant, on the start path. Only reads on that path ahead of the store
+// can see the global unset, everything else runs after it.
+func (o *Optimizer) propagateGlobals() int {
+	stores := o.globalStores()
+	type pos struct {
+		block label
+		index int
+	}
+	consts := make(map[string]int)
+	before := make(map[pos]bool)
+	o.walkStart(func(l label, i int) {
+		code := o.blocks[l].code
+		switch inst := code[i]; inst.Op {
+		case OpSetGlobal:
+			name, _ := inst.Arg.(string)
+			if i > 0 && stores[name] == 1 {
+				if c, ok := o.propagableConst(code[i-1]); ok {
+					consts[name] = c
+				}
+			}
+		case OpGetGlobal:
+			if _, ok := consts[inst.Arg.(string)]; !ok {
+				before[pos{l, i}] = true
+			}
+		}
+	})
+	if len(consts) == 0 {
+		return 0
+	}
+
+	replaced := 0
+	for i, b := range o.blocks {
+		for j, inst := range b.code {
+			if inst.Op != OpGetGlobal || before[pos{label(i), j}] {
+				continue
+			}
+			name, _ := inst.Arg.(string)
+			if c, ok := consts[name]; ok {
+				b.code[j] = Instruction{Op: OpConstant, Arg: float64(c), Line: inst.Line}
+				replaced++
+			}
+		}
+	}
+	return replaced
+}
+
+// globalStores counts the SET_GLOBALs of each name.
+func (o *Optimizer) globalStores() map[string]int {
+	stores := make(map[string]int)
+	for _, b := range o.blocks {
+		for _, inst := range b.code {
+			if inst.Op == OpSetGlobal {
+				name, _ := inst.Arg.(string)
+				stores[name]++
+			}
+		}
+	}
+	return stores
+}
+
+// walkStart calls visit for each instruction on the start path: the code that
+// runs first when the unit starts, following jumps, up to the first
+// instruction that could run other code. Globals stored on it are set before
+// any function or other unit can run.
+func (o *Optimizer) walkStart(visit func(l label, i int)) {
+	visited := make(map[label]bool)
+	l := label(0)
+walk:
+	for !visited[l] {
+		visited[l] = true
+		for i, inst := range o.blocks[l].code {
+			switch inst.Op {
+			case OpConstant, OpGetLocal, OpSetLocal, OpMakeFunc, OpPop, OpReserve, OpNop, OpTable, OpGetGlobal, OpSetGlobal:
+				visit(l, i)
+			case OpJump:
+				target, ok := inst.Arg.(label)
+				if !ok {
+					break walk
+				}
+				l = target
+				continue walk
+			default:
+				break walk
+			}
+		}
+		if int(l)+1 >= len(o.blocks) {
+			break
+		}
+		l++
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Disassemble writes a readable listing of a program: the constant pool,
+// then every instruction with its source line, decoded argument and jump
+// labels. Function bodies are found through the funcptr constants and
+// module boundaries come from the image's module table.
+func Disassemble(w io.Writer, instructions []Instruction, constants []Constant, modules []ModuleEntry) {
+	funcs := findFunctions(instructions, constants)
+
+	fmt.Fprintf(w, "constants (%d):\n", len(constants))
+	for i, c := range constants {
+		fmt.Fprintf(w, "%6d  %-8s %s\n", i, c.Type, describeConstant(c, funcs))
+	}
+
+	fmt.Fprintf(w, "\ncode (%d):\n", len(instructions))
+	disassembleCode(w, instructions, constants, modules, 0, len(instructions))
+}
+
+// disassembleCode lists the instructions in [start, end).
+func disassembleCode(w io.Writer, instructions []Instruction, constants []Constant, modules []ModuleEntry, start int, end int) {
+	funcs := findFunctions(instructions, constants)
+	labels := make(map[int]bool)
+	for _, inst := range instructions {
+		if isJump(inst.Op) {
+			if target := int(toFloat64(inst.Arg)); target >= 0 {
+				labels[target] = true
+			}
+		}
+	}
+
+	ends := make(map[int][]string)
+	for ip := start; ip < end; ip++ {
+		inst := instructions[ip]
+		for _, name := range ends[ip] {
+			fmt.Fprintf(w, "-- end %s --\n", name)
+		}
+		for _, mod := range modules {
+			if mod.Start == ip {
+				fmt.Fprintf(w, "-- module %s --\n", mod.Name)
+			}
+		}
+		if fn, ok := funcs[ip]; ok {
+			fmt.Fprintf(w, "-- func %s --\n", fn.name)
+			if fn.end > ip {
+				ends[fn.end] = append(ends[fn.end], "func "+fn.name)
+			}
+		}
+		if labels[ip] {
+			fmt.Fprintf(w, "L%d:\n", ip)
+		}
+
+		line := ""
+		if inst.Line > 0 {
+			line = fmt.Sprintf("%d", inst.Line)
+		}
+		arg := describeArg(inst, constants, funcs)
+		if arg == "" {
+			fmt.Fprintf(w, "%6d  %5s  %s\n", ip, line, inst.Op)
+			continue
+		}
+		fmt.Fprintf(w, "%6d  %5s  %-14s %s\n", ip, line, inst.Op, arg)
+	}
+	for _, name := range ends[end] {
+		fmt.Fprintf(w, "-- end %s --\n", name)
+	}
+}
+
+type funcInfo struct {
+	name string
+	end  int
+}
+
+// findFunctions maps each function entry to a display name and the end of
+// its body. Function definitions jump over their body, so the jump right
+// before the entry tells where the body stops.
+func findFunctions(instructions []Instruction, constants []Constant) map[int]funcInfo {
+	funcs := make(map[int]funcInfo)
+	for _, c := range constants {
+		if c.Type != "funcptr" {
+			continue
+		}
+		entry := int(toFloat64(c.Value))
+		end := -1
+		if entry > 0 && entry <= len(instructions) && instructions[entry-1].Op == OpJump {
+			end = int(toFloat64(instructions[entry-1].Arg))
+		}
+		funcs[entry] = funcInfo{name: fmt.Sprintf("@%d", entry), end: end}
+	}
+
+	for i, inst := range instructions {
+		if inst.Op != OpMakeFunc || i+1 >= len(instructions) {
+			continue
+		}
+		idx := int(toFloat64(inst.Arg))
+		if idx < 0 || idx >= len(constants) {
+			continue
+		}
+		entry := int(toFloat64(constants[idx].Value))
+		fn, ok := funcs[entry]
+		if !ok {
+			continue
+		}
+		next := instructions[i+1]
+		switch next.Op {
+		case OpSetGlobal:
+			fn.name = fmt.Sprintf("%v", next.Arg)
+		case OpSetLocal:
+			fn.name = fmt.Sprintf("local %d", int(toFloat64(next.Arg)))
+		case OpSetIndex:
+			if i >= 2 && instructions[i-1].Op == OpConstant {
+				key := describeConstantAt(instructions[i-1].Arg, constants)
+				owner := "?"
+				if instructions[i-2].Op == OpGetGlobal {
+					owner = fmt.Sprintf("%v", instructions[i-2].Arg)
+				}
+				fn.name = owner + "." + strings.Trim(key, `"`)
+			}
+		default:
+			fn.name = fmt.Sprintf("anonymous@%d", entry)
+		}
+		funcs[entry] = fn
+	}
+	return funcs
+}
+
+func isJump(op OpCode) bool {
+	return op == OpJump || op == OpJumpIfFalse || op == OpTry
+}
+
+func describeConstant(c Constant, funcs map[int]funcInfo) string {
+	switch c.Type {
+	case "string":
+		return fmt.Sprintf("%q", c.Value)
+	case "funcptr":
+		entry := int(toFloat64(c.Value))
+		if fn, ok := funcs[entry]; ok && fn.name != fmt.Sprintf("@%d", entry) {
+			return fmt.Sprintf("@%d (%s)", entry, fn.name)
+		}
+		return fmt.Sprintf("@%d", entry)
+	case "nil":
+		return "nil"
+	}
+	return fmt.Sprintf("%v", c.Value)
+}
+
+func describeConstantAt(arg interface{}, constants []Constant) string {
+	idx := int(toFloat64(arg))
+	if idx < 0 || idx >= len(constants) {
+		return "<bad constant>"
+	}
+	return describeConstant(constants[idx], nil)
+}
+
+func describeArg(inst Instruction, constants []Constant, funcs map[int]funcInfo) string {
+	if inst.Arg == nil {
+		return ""
+	}
+	switch inst.Op {
+	case OpConstant, OpMakeFunc:
+		idx := int(toFloat64(inst.Arg))
+		if idx < 0 || idx >= len(constants) {
+			return fmt.Sprintf("%d ; <bad constant>", idx)
+		}
+		return fmt.Sprintf("%d ; %s", idx, describeConstant(constants[idx], funcs))
+	case OpJump, OpJumpIfFalse, OpTry:
+		target := int(toFloat64(inst.Arg))
+		if target < 0 {
+			return fmt.Sprintf("%d ; unpatched", target)
+		}
+		return fmt.Sprintf("L%d", target)
+	case OpGetLocal, OpSetLocal:
+		return fmt.Sprintf("slot %d", int(toFloat64(inst.Arg)))
+	case OpCallNative:
+		if idx := int(toFloat64(inst.Arg)); idx >= 0 && idx < len(nativeNames) {
+			return fmt.Sprintf("%d ; %s", idx, nativeNames[idx])
+		}
+	case OpCallDirect:
+		if call, ok := inst.Arg.(directCall); ok {
+			return fmt.Sprintf("@%d ; %s", call.entry, call.name)
+		}
+	}
+	return fmt.Sprintf("%v", inst.Arg)
+}
@@ -0,0 +1,151 @@
+package main
+
+// Control flow passes: removing definitions of functions nothing calls,
+// folding branches on constant conditions, threading jumps through jumps and
+// dropping code no path reaches. They work on the blocks, so removing code
+// never has to move a jump target.
+
+// doDeadCode runs the control flow passes until none of them changes
+// anything and returns how many changes they made.
+func (o *Optimizer) doDeadCode() int {
+	total := 0
+	for {
+		functions := o.removeUnusedFunctions()
+		branches := o.foldBranches()
+		jumps := o.threadJumps()
+		unreachable := o.removeUnreachable()
+		o.stats.functions += functions
+		o.stats.branches += branches
+		o.stats.jumps += jumps
+		o.stats.unreachable += unreachable
+
+		changed := functions + branches + jumps + unreachable
+		if changed == 0 {
+			return total
+		}
+		total += changed
+	}
+}
+
+// removeUnusedFunctions drops `MAKE_FUNC; SET_GLOBAL name` when nothing reads
+// or calls name, which leaves the function's body unreachable.
+func (o *Optimizer) removeUnusedFunctions() int {
+	used := make(map[string]bool)
+	for _, b := range o.blocks {
+		for _, inst := range b.code {
+			switch inst.Op {
+			case OpGetGlobal, OpCall, OpTailCall:
+				if name, ok := inst.Arg.(string); ok {
+					used[name] = true
+				}
+			}
+		}
+	}
+
+	removed := 0
+	for _, b := range o.blocks {
+		code := b.code[:0]
+		for i := 0; i < len(b.code); i++ {
+			if i+1 < len(b.code) && b.code[i].Op == OpMakeFunc && b.code[i+1].Op == OpSetGlobal {
+				name, _ := b.code[i+1].Arg.(string)
+				if !used[name] && !o.isExported(name) {
+					i++
+					removed++
+					continue
+				}
+			}
+			code = append(code, b.code[i])
+		}
+		b.code = code
+	}
+	return removed
+}
+
+// foldBranches resolves `CONSTANT; JUMP_IF_FALSE` at compile time: a true
+// condition falls through and a false one always jumps.
+func (o *Optimizer) foldBranches() int {
+	folded := 0
+	for _, b := range o.blocks {
+		n := len(b.code)
+		if n < 2 || b.code[n-2].Op != OpConstant || b.code[n-1].Op != OpJumpIfFalse {
+			continue
+		}
+		c := o.Constants[int(toFloat64(b.code[n-2].Arg))]
+		if c.Type == "funcptr" {
+			continue
+		}
+		if constantValue(c).Truthy() {
+			b.code = b.code[:n-2]
+		} else {
+			b.code[n-1].Op = OpJump
+			b.code = append(b.code[:n-2], b.code[n-1])
+		}
+		folded++
+	}
+	return folded
+}
+
+// threadJumps points jumps that land on a block holding nothing but another
+// JUMP straight at that jump's target.
+func (o *Optimizer) threadJumps() int {
+	forward := func(l label) (label, bool) {
+		code := o.blocks[l].code
+		if len(code) != 1 || code[0].Op != OpJump {
+			return l, false
+		}
+		next, ok := code[0].Arg.(label)
+		return next, ok && next != l
+	}
+
+	threaded := 0
+	for _, b := range o.blocks {
+		if len(b.code) == 0 {
+			continue
+		}
+		last := &b.code[len(b.code)-1]
+		target, ok := last.Arg.(label)
+		if !ok || (last.Op != OpJump && last.Op != OpJumpIfFalse) {
+			continue
+		}
+		for hops := 0; hops < len(o.blocks); hops++ {
+			next, ok := forward(target)
+			if !ok {
+				break
+			}
+			target = next
+		}
+		if target != last.Arg.(label) {
+			last.Arg = target
+			threaded++
+		}
+	}
+	return threaded
+}
+
+// removeUnreachable empties the blocks that no path from the start of the
+// unit reaches and returns how many instructions that removed. A function
+// body counts as reached when the MAKE_FUNC creating it is.
+func (o *Optimizer) removeUnreachable() int {
+	reached := make([]bool, len(o.blocks))
+	work := []label{0}
+	reached[0] = true
+	for len(work) > 0 {
+		l := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, next := range o.successors(l, o.blocks[l]) {
+			if !reached[next] {
+				reached[next] = true
+				work = append(work, next)
+			}
+		}
+	}
+
+	removed := 0
+	for i, b := range o.blocks {
+		if !reached[i] {
+			removed += len(b.code)
+			b.code = nil
+		}
+	}
+	return removed
+}
@@ -0,0 +1,180 @@
+package main
+
+import "lightlang/builtins"
+
+// Superinstructions. fuseOps looks for short instruction sequences that hot
+// loops are made of and replaces the op at the start of each with one closure
+// doing the whole sequence on numbers. The ops after it are left alone, so a
+// jump into the middle of a sequence still runs the original instructions,
+// and when the values aren't numbers the fused op just runs the first
+// original op and lets the rest follow as usual.
+
+// varRef is a local or global slot read or written by a fused op.
+type varRef struct {
+	global bool
+	slot   int
+}
+
+func (r varRef) load(v *VM, f *Frame) Value {
+	if r.global {
+		return v.globals[r.slot]
+	}
+	return v.Stack[f.Sp+r.slot]
+}
+
+func (r varRef) store(v *VM, f *Frame, val Value) {
+	if r.global {
+		v.storeGlobal(r.slot, val)
+	} else {
+		v.Stack[f.Sp+r.slot] = val
+	}
+}
+
+// operand is a variable read or a number constant.
+type operand struct {
+	varRef
+	isConst bool
+	num     float64
+}
+
+func (o operand) number(v *VM, f *Frame) (float64, bool) {
+	if o.isConst {
+		return o.num, true
+	}
+	return o.load(v, f).Num()
+}
+
+func (v *VM) operandOf(inst Instruction) (operand, bool) {
+	switch inst.Op {
+	case OpGetLocal:
+		return operand{varRef: varRef{slot: int(toFloat64(inst.Arg))}}, true
+	case OpGetGlobal:
+		return operand{varRef: varRef{global: true, slot: v.globalSlot(inst.Arg.(string))}}, true
+	case OpConstant:
+		c := v.Constants[int(toFloat64(inst.Arg))]
+		if c.Type == "number" {
+			return operand{isConst: true, num: toFloat64(c.Value)}, true
+		}
+	}
+	return operand{}, false
+}
+
+func (v *VM) storeOf(inst Instruction) (varRef, bool) {
+	switch inst.Op {
+	case OpSetLocal:
+		return varRef{slot: int(toFloat64(inst.Arg))}, true
+	case OpSetGlobal:
+		return varRef{global: true, slot: v.globalSlot(inst.Arg.(string))}, true
+	}
+	return varRef{}, false
+}
+
+// Division is left out since it has to check for zero.
+var fusedArith = map[OpCode]func(a, b float64) float64{
+	OpAdd: func(a, b float64) float64 { return a + b },
+	OpSub: func(a, b float64) float64 { return a - b },
+	OpMul: func(a, b float64) float64 { return a * b },
+}
+
+var fusedCompare = map[OpCode]func(a, b float64) bool{
+	OpCmpEq:  func(a, b float64) bool { return a == b },
+	OpCmpNe:  func(a, b float64) bool { return a != b },
+	OpCmpLt:  func(a, b float64) bool { return a < b },
+	OpCmpLte: func(a, b float64) bool { return a <= b },
+	OpCmpGt:  func(a, b float64) bool { return a > b },
+	OpCmpGte: func(a, b float64) bool { return a >= b },
+}
+
+// fuseOps fuses the sequences starting in ops[start:], which were built from
+// v.Instructions[start:].
+func (v *VM) fuseOps(ops []opFunc, start int) {
+	for i := start; i < len(ops); i++ {
+		if op := v.fuse(i, ops[i]); op != nil {
+			ops[i] = op
+		}
+	}
+}
+
+func (v *VM) fuse(i int, orig opFunc) opFunc {
+	code := v.Instructions
+	at := func(n int) Instruction {
+		if i+n < len(code) {
+			return code[i+n]
+		}
+		return Instruction{Op: OpHalt}
+	}
+
+	a, okA := v.operandOf(at(0))
+	b, okB := v.operandOf(at(1))
+	if !okA || !okB {
+		if cmp, ok := fusedCompare[at(0).Op]; ok && at(1).Op == OpJumpIfFalse {
+			return compareJump(cmp, int(toFloat64(at(1).Arg)), i+2, orig)
+		}
+		return nil
+	}
+	next := i + 3
+
+	// x = a + b, the add-constant-to-variable and increment case
+	if arith, ok := fusedArith[at(2).Op]; ok {
+		if dst, ok := v.storeOf(at(3)); ok {
+			return func(v *VM, f *Frame) error {
+				x, ok1 := a.number(v, f)
+				y, ok2 := b.number(v, f)
+				if !ok1 || !ok2 {
+					return orig(v, f)
+				}
+				dst.store(v, f, builtins.Number(arith(x, y)))
+				f.Ip = next + 1
+				return nil
+			}
+		}
+		return func(v *VM, f *Frame) error {
+			x, ok1 := a.number(v, f)
+			y, ok2 := b.number(v, f)
+			if !ok1 || !ok2 {
+				return orig(v, f)
+			}
+			v.push(builtins.Number(arith(x, y)))
+			f.Ip = next
+			return nil
+		}
+	}
+
+	// loop and if conditions like `i < n`
+	if cmp, ok := fusedCompare[at(2).Op]; ok && at(3).Op == OpJumpIfFalse {
+		target := int(toFloat64(at(3).Arg))
+		return func(v *VM, f *Frame) error {
+			x, ok1 := a.number(v, f)
+			y, ok2 := b.number(v, f)
+			if !ok1 || !ok2 {
+				return orig(v, f)
+			}
+			if cmp(x, y) {
+				f.Ip = next + 1
+			} else {
+				f.Ip = target
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// compareJump fuses a comparison with the conditional jump after it, for
+// operands already on the stack.
+func compareJump(cmp func(a, b float64) bool, target, next int, orig opFunc) opFunc {
+	return func(v *VM, f *Frame) error {
+		x, ok1 := v.Stack[v.Sp-2].Num()
+		y, ok2 := v.Stack[v.Sp-1].Num()
+		if !ok1 || !ok2 {
+			return orig(v, f)
+		}
+		v.Sp -= 2
+		if cmp(x, y) {
+			f.Ip = next
+		} else {
+			f.Ip = target
+		}
+		return nil
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import "lightlang/builtins"
+
+// Inlining. A call to a small function that is a single run of code ending
+// in its return is replaced by the function's code, working in fresh local
+// slots of the caller's frame. Whatever the function returns is left on the
+// stack, just as the call would have.
+
+// inlineLimit is the most instructions a function body may have to be
+// inlined, and frameLimit the most local slots inlining grows a frame to.
+const (
+	inlineLimit = 16
+	frameLimit  = 256
+)
+
+// inlinee is a function inlining can copy: body is its code without the
+// RESERVE in front and the RETURN at the end.
+type inlinee struct {
+	entry label
+	slots int
+	body  []Instruction
+}
+
+// doInlining returns how many calls it replaced.
+func (o *Optimizer) doInlining() int {
+	funcs := o.inlinees()
+	if len(funcs) == 0 {
+		return 0
+	}
+
+	nilConst := -1
+	inlined := 0
+	for _, blocks := range o.frames() {
+		root := blocks[0]
+		slots := int(toFloat64(o.blocks[root].code[0].Arg))
+		for _, l := range blocks {
+			b := o.blocks[l]
+			var code []Instruction
+			for i := 0; i < len(b.code); i++ {
+				inst := b.code[i]
+				name, _ := inst.Arg.(string)
+				fn, ok := funcs[name]
+				count, counted := 0, false
+				if ok && inst.Op == OpCall {
+					count, counted = o.callCount(b.code, i)
+				}
+				width := fn.slots
+				if count > width {
+					width = count
+				}
+				base := slots
+				if !counted || fn.entry == root || base+width > frameLimit {
+					code = append(code, inst)
+					continue
+				}
+
+				// The argument count the call would have popped goes, then
+				// the arguments move into the new slots, last one first.
+				code = code[:len(code)-1]
+				for k := count - 1; k >= 0; k-- {
+					code = append(code, Instruction{Op: OpSetLocal, Arg: float64(base + k), Line: inst.Line})
+				}
+				for k := count; k < fn.slots; k++ {
+					if nilConst < 0 {
+						nilConst = len(o.Constants)
+						o.Constants = append(o.Constants, Constant{Value: nil, Type: "nil"})
+					}
+					code = append(code, Instruction{Op: OpConstant, Arg: float64(nilConst), Line: inst.Line})
+					code = append(code, Instruction{Op: OpSetLocal, Arg: float64(base + k), Line: inst.Line})
+				}
+				for _, in := range fn.body {
+					if in.Op == OpGetLocal || in.Op == OpSetLocal {
+						in.Arg = float64(base + int(toFloat64(in.Arg)))
+					}
+					code = append(code, in)
+				}
+				slots = base + width
+				inlined++
+			}
+			b.code = code
+		}
+		o.blocks[root].code[0].Arg = float64(slots)
+	}
+	return inlined
+}
+
+// inlinees finds the functions worth inlining by the name calls use: defined
+// once by the unit on its start path, so no call can run before the
+// definition, not named like a builtin, which calls would reach instead, and
+// whose body is one short block that leaves just its result on the stack.
+func (o *Optimizer) inlinees() map[string]inlinee {
+	stores := o.globalStores()
+	defs := make(map[string]label)
+	o.walkStart(func(l label, i int) {
+		code := o.blocks[l].code
+		if code[i].Op != OpSetGlobal || i == 0 || code[i-1].Op != OpMakeFunc {
+			return
+		}
+		if entry, ok := o.Constants[int(toFloat64(code[i-1].Arg))].Value.(label); ok {
+			name, _ := code[i].Arg.(string)
+			defs[name] = entry
+		}
+	})
+
+	funcs := make(map[string]inlinee)
+	for name, entry := range defs {
+		if _, builtin := builtins.Builtins[name]; builtin || stores[name] != 1 {
+			continue
+		}
+		code := o.blocks[entry].code
+		n := len(code)
+		if n < 2 || n > inlineLimit || code[0].Op != OpReserve || code[n-1].Op != OpReturn {
+			continue
+		}
+		body := code[1 : n-1]
+		if o.inlinable(name, body) {
+			funcs[name] = inlinee{entry: entry, slots: int(toFloat64(code[0].Arg)), body: body}
+		}
+	}
+	return funcs
+}
+
+// inlinable checks a body uses nothing tied to its own frame and ends with
+// exactly one more value on the stack than it started with.
+func (o *Optimizer) inlinable(name string, body []Instruction) bool {
+	height := 0
+	for i, inst := range body {
+		count := 0
+		switch inst.Op {
+		case OpCall, OpCallIndirect, OpCallMethod:
+			if target, _ := inst.Arg.(string); inst.Op == OpCall && target == name {
+				return false
+			}
+			var ok bool
+			if count, ok = o.callCount(body, i); !ok {
+				return false
+			}
+		case OpTailCall, OpReturn, OpReserve, OpTry, OpEndTry, OpMakeFunc, OpImport:
+			return false
+		}
+		pops, pushes := stackEffect(inst, count)
+		if height < pops {
+			return false
+		}
+		height += pushes - pops
+	}
+	return height == 1
+}
+
+// frames groups the reachable blocks by the frame they run in, starting each
+// group with the block the frame starts at: the unit's first block or a
+// function entry. Only frames starting with RESERVE can take new slots, the
+// others are left out.
+func (o *Optimizer) frames() [][]label {
+	roots := []label{0}
+	for _, c := range o.Constants {
+		if entry, ok := c.Value.(label); ok {
+			roots = append(roots, entry)
+		}
+	}
+
+	var frames [][]label
+	seen := make([]bool, len(o.blocks))
+	for _, root := range roots {
+		code := o.blocks[root].code
+		if seen[root] || len(code) == 0 || code[0].Op != OpReserve {
+			continue
+		}
+		seen[root] = true
+		var frame []label
+		work := []label{root}
+		for len(work) > 0 {
+			l := work[len(work)-1]
+			work = work[:len(work)-1]
+			frame = append(frame, l)
+			next := o.edges(l, o.blocks[l])
+			for _, inst := range o.blocks[l].code {
+				if target, ok := inst.Arg.(label); ok && inst.Op == OpTry {
+					next = append(next, target)
+				}
+			}
+			for _, n := range next {
+				if !seen[n] {
+					seen[n] = true
+					work = append(work, n)
+				}
+			}
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"lightlang/builtins"
+	"testing"
+)
+
+// runOptimized compiles source, optimizes it with opt and returns what it
+// printed, runtime errors included.
+func runOptimized(t *testing.T, source string, opt OptOptions) string {
+	t.Helper()
+	instructions, constants, symbols, err := Compile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM()
+	vm.Instructions, vm.Constants = OptimizeUnit("", instructions, constants, symbols, opt)
+
+	var out bytes.Buffer
+	prev := builtins.Output
+	builtins.Output = &out
+	defer func() { builtins.Output = prev }()
+	if err := vm.Run(""); err != nil {
+		out.WriteString("Runtime Error: " + err.Error() + "\n")
+	}
+	return out.String()
+}
+
+// A call that runs before the function's definition fails, however small the
+// function is.
+func TestInlineAfterDefinition(t *testing.T) {
+	source := `try
+  print(f(1))
+catch e
+  print("caught: " + e)
+end
+func f(x)
+  return x + 1
+end
+print(f(1))
+`
+	want := "caught: function 'f' not found\n2\n"
+	for level := 0; level <= 1; level++ {
+		if got := runOptimized(t, source, OptLevel(level)); got != want {
+			t.Errorf("-O%d printed %q, want %q", level, got, want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+// Loop-invariant code motion. An array or a string never changes length in
+// place and never has a metatable, so len() of a variable that only ever
+// holds one gives the same answer on every trip round a loop that doesn't
+// assign the variable. When a loop's header works that len() out before
+// doing anything else, the call moves in front of the loop into a new local
+// slot, which the header reads instead.
+
+// arrayBuiltins always return an array when they return at all.
+var arrayBuiltins = map[string]bool{
+	"push": true, "pop": true, "range": true, "pairs": true, "ipairs": true, "split": true, "keys": true,
+}
+
+// loop is a natural loop: body holds its blocks, header included, and
+// control only enters it through the header.
+type loop struct {
+	header label
+	body   map[label]bool
+}
+
+// doHoisting returns how many len() calls it moved out of loops.
+func (o *Optimizer) doHoisting() int {
+	hoisted := 0
+	for _, frame := range o.frames() {
+		root := frame[0]
+		slots := int(toFloat64(o.blocks[root].code[0].Arg))
+		loops := o.loops(frame)
+		if len(loops) == 0 {
+			continue
+		}
+		known := o.frameArrays(frame)
+		for _, lp := range loops {
+			if slots >= frameLimit {
+				break
+			}
+			if o.hoistLen(lp, frame, known[lp.header], slots) {
+				slots++
+				hoisted++
+			}
+		}
+		o.blocks[root].code[0].Arg = float64(slots)
+	}
+	return hoisted
+}
+
+// loops finds the natural loops of a frame from its jumps back to a block
+// that comes earlier. A loop that can be entered other than through its
+// header is left out.
+func (o *Optimizer) loops(frame []label) []loop {
+	in := make(map[label]bool, len(frame))
+	for _, l := range frame {
+		in[l] = true
+	}
+	preds := make(map[label][]label)
+	for _, l := range frame {
+		for _, next := range o.frameEdges(l) {
+			preds[next] = append(preds[next], l)
+		}
+	}
+
+	var out []loop
+	found := make(map[label]int)
+	for _, l := range frame {
+		for _, h := range o.frameEdges(l) {
+			if h > l || !in[h] {
+				continue
+			}
+			i, ok := found[h]
+			if !ok {
+				i = len(out)
+				found[h] = i
+				out = append(out, loop{header: h, body: map[label]bool{h: true}})
+			}
+			body := out[i].body
+			work := []label{l}
+			for len(work) > 0 {
+				b := work[len(work)-1]
+				work = work[:len(work)-1]
+				if body[b] {
+					continue
+				}
+				body[b] = true
+				work = append(work, preds[b]...)
+			}
+		}
+	}
+
+	natural := out[:0]
+	for _, lp := range out {
+		entered := false
+		for b := range lp.body {
+			for _, p := range preds[b] {
+				if b != lp.header && !lp.body[p] {
+					entered = true
+				}
+			}
+		}
+		if !entered {
+			natural = append(natural, lp)
+		}
+	}
+	return natural
+}
+
+// frameEdges is edges plus the catch blocks of the try blocks l opens, the
+// ways control moves within a frame.
+func (o *Optimizer) frameEdges(l label) []label {
+	b := o.blocks[l]
+	out := o.edges(l, b)
+	for _, inst := range b.code {
+		if target, ok := inst.Arg.(label); ok && inst.Op == OpTry {
+			out = append(out, target)
+		}
+	}
+	return out
+}
+
+// hoistLen moves `GET v; CONSTANT 1; CALL len` from the start of the loop's
+// header to the end of the block in front of it, storing the result in slot.
+// known holds the variables that are arrays or strings on entry to the header.
+// Only local reads and constants may come before it in the header, so the
+// call still happens, or fails, before anything else the loop does.
+func (o *Optimizer) hoistLen(lp loop, frame []label, known arrayVars, slot int) bool {
+	pre := lp.header - 1
+	if pre < 0 || lp.body[pre] || !o.onlyEntry(lp, pre) {
+		return false
+	}
+	preCode := o.blocks[pre].code
+	at := len(preCode)
+	if at > 0 {
+		last := preCode[at-1]
+		if target, ok := last.Arg.(label); ok && last.Op == OpJump && target == lp.header {
+			at--
+		} else if endsBlock(last.Op) {
+			return false
+		}
+	}
+
+	code := o.blocks[lp.header].code
+	for i := 0; i+2 < len(code); i++ {
+		read, count, call := code[i], code[i+1], code[i+2]
+		if name, _ := call.Arg.(string); call.Op == OpCall && name == "len" &&
+			o.isConst(count, 1) &&
+			o.invariantArray(read, lp, frame, known) {
+			moved := []Instruction{read, count, call, {Op: OpSetLocal, Arg: float64(slot), Line: call.Line}}
+			preCode = append(preCode[:at], append(moved, preCode[at:]...)...)
+			o.blocks[pre].code = preCode
+
+			code[i] = Instruction{Op: OpGetLocal, Arg: float64(slot), Line: read.Line}
+			o.blocks[lp.header].code = append(code[:i+1], code[i+3:]...)
+			return true
+		}
+		if code[i].Op != OpGetLocal && code[i].Op != OpConstant {
+			return false
+		}
+	}
+	return false
+}
+
+// isConst reports whether inst pushes the number n.
+func (o *Optimizer) isConst(inst Instruction, n float64) bool {
+	if inst.Op != OpConstant {
+		return false
+	}
+	c := o.Constants[int(toFloat64(inst.Arg))]
+	return c.Type == "number" && toFloat64(c.Value) == n
+}
+
+// onlyEntry reports whether pre is the one block outside the loop control
+// reaches its header from.
+func (o *Optimizer) onlyEntry(lp loop, pre label) bool {
+	for l, b := range o.blocks {
+		if lp.body[label(l)] || label(l) == pre || len(b.code) == 0 {
+			continue
+		}
+		for _, next := range o.frameEdges(label(l)) {
+			if next == lp.header {
+				return false
+			}
+		}
+	}
+	for _, next := range o.frameEdges(pre) {
+		if next == lp.header {
+			return true
+		}
+	}
+	return false
+}
+
+// arrayVars holds the variables known to hold an array or a string, keyed by
+// the argument of the instructions that read and store them: a slot number
+// for a local, a name for a global.
+type arrayVars map[interface{}]bool
+
+// meet keeps the variables a and b agree on.
+func (a arrayVars) meet(b arrayVars) arrayVars {
+	out := make(arrayVars)
+	for v := range a {
+		if b[v] {
+			out[v] = true
+		}
+	}
+	return out
+}
+
+// stepArrays runs the stores of b over the variables known on entry.
+func (o *Optimizer) stepArrays(b *block, known arrayVars) arrayVars {
+	out := make(arrayVars, len(known))
+	for v := range known {
+		out[v] = true
+	}
+	for i, inst := range b.code {
+		if inst.Op != OpSetLocal && inst.Op != OpSetGlobal {
+			continue
+		}
+		if i > 0 && o.pushesArray(b.code[i-1]) {
+			out[inst.Arg] = true
+		} else {
+			delete(out, inst.Arg)
+		}
+	}
+	return out
+}
+
+// frameArrays finds the variables known to hold an array or a string on
+// entry to each block of a frame. Parameters, the host's globals and caught
+// values aren't known, so the frame's start and its catch blocks begin
+// knowing nothing.
+func (o *Optimizer) frameArrays(frame []label) map[label]arrayVars {
+	in := map[label]arrayVars{frame[0]: {}}
+	work := []label{frame[0]}
+	for _, l := range frame {
+		for _, inst := range o.blocks[l].code {
+			if target, ok := inst.Arg.(label); ok && inst.Op == OpTry {
+				in[target] = arrayVars{}
+				work = append(work, target)
+			}
+		}
+	}
+	for len(work) > 0 {
+		l := work[len(work)-1]
+		work = work[:len(work)-1]
+		out := o.stepArrays(o.blocks[l], in[l])
+		for _, next := range o.edges(l, o.blocks[l]) {
+			merged := out
+			if known, ok := in[next]; ok {
+				merged = known.meet(out)
+				if len(merged) == len(known) {
+					continue
+				}
+			}
+			in[next] = merged
+			work = append(work, next)
+		}
+	}
+	return in
+}
+
+// invariantArray reports whether read is of a variable that holds an array
+// or a string whenever the loop starts and that the loop never assigns. A
+// global must only be stored by the unit's top level code, which runs once,
+// so no call the loop makes can store it either.
+func (o *Optimizer) invariantArray(read Instruction, lp loop, frame []label, known arrayVars) bool {
+	var store OpCode
+	switch read.Op {
+	case OpGetLocal:
+		store = OpSetLocal
+	case OpGetGlobal:
+		if frame[0] != 0 {
+			return false
+		}
+		store = OpSetGlobal
+	default:
+		return false
+	}
+	if !known[read.Arg] {
+		return false
+	}
+
+	top := make(map[label]bool, len(frame))
+	for _, l := range frame {
+		top[l] = true
+	}
+	for l, b := range o.blocks {
+		for _, inst := range b.code {
+			if inst.Op == store && inst.Arg == read.Arg && (lp.body[label(l)] || !top[label(l)]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pushesArray reports whether inst always leaves an array or a string on the
+// stack.
+func (o *Optimizer) pushesArray(inst Instruction) bool {
+	switch inst.Op {
+	case OpArray:
+		return true
+	case OpConstant:
+		return o.Constants[int(toFloat64(inst.Arg))].Type == "string"
+	case OpCall:
+		name, _ := inst.Arg.(string)
+		return arrayBuiltins[name]
+	}
+	return false
+}
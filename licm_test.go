@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Moving len() out of a loop only happens when the loop can't change the
+// length, so the output always matches the unoptimized program's.
+func TestHoistLen(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		want    string
+		hoisted int
+	}{
+		{"unchanged array", `let items = [1, 2, 3]
+for x in items do
+  print(x)
+end
+`, "1\n2\n3\n", 1},
+		{"assigned in the loop", `let items = [1, 2, 3]
+for x in items do
+  items = [x]
+  print(x)
+end
+`, "1\n", 0},
+		{"growing table", `let t = {}
+t[0] = "a"
+t[1] = "b"
+for v in t do
+  t[2] = "c"
+  print(v)
+end
+`, "a\nb\nc\n", 0},
+		{"assigned by a call", `let items = [1, 2]
+func grow()
+  if len(items) < 3 then
+    items = push(items, 3)
+  end
+end
+for x in items do
+  grow()
+  print(x)
+end
+`, "1\n2\n3\n", 0},
+		{"array from a builtin", `let words = split("a b c", " ")
+for w in words do
+  print(w)
+end
+`, "a\nb\nc\n", 1},
+		{"table on one path", `let items = [1, 2]
+if tick() < 0 then
+  items = {}
+end
+for x in items do
+  print(x)
+end
+`, "1\n2\n", 0},
+	}
+	for _, tt := range tests {
+		if got := runOptimized(t, tt.source, OptLevel(0)); got != tt.want {
+			t.Errorf("%s: -O0 printed %q, want %q", tt.name, got, tt.want)
+		}
+		var report bytes.Buffer
+		opt := OptLevel(2)
+		opt.Report = &report
+		if got := runOptimized(t, tt.source, opt); got != tt.want {
+			t.Errorf("%s: -O2 printed %q, want %q", tt.name, got, tt.want)
+		}
+		hoisted := 0
+		if _, n, ok := strings.Cut(report.String(), "len() calls moved out of loops: "); ok {
+			hoisted = int(n[0] - '0')
+		}
+		if hoisted != tt.hoisted {
+			t.Errorf("%s: hoisted %d len() calls, want %d", tt.name, hoisted, tt.hoisted)
+		}
+	}
+}
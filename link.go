@@ -0,0 +1,82 @@
+package main
+
+import (
+	"lightlang/builtins"
+	"sort"
+)
+
+// nativeNames lists the builtins in the order CALL_NATIVE indexes them. The
+// order only exists inside a running VM: files keep calling builtins by name,
+// so adding a builtin never breaks programs that were already built.
+var nativeNames, natives, nativeIndex = nativeTable()
+
+func nativeTable() ([]string, []builtins.BuiltinFunc, map[string]int) {
+	names := make([]string, 0, len(builtins.Builtins))
+	for name := range builtins.Builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fns := make([]builtins.BuiltinFunc, len(names))
+	index := make(map[string]int, len(names))
+	for i, name := range names {
+		fns[i] = builtins.Builtins[name]
+		index[name] = i
+	}
+	return names, fns, index
+}
+
+// directCall is the argument of CALL_DIRECT: the entry of the function, the
+// global its definition assigns and the generation the global has once that
+// definition has run.
+type directCall struct {
+	entry   int
+	name    string
+	defined uint64
+}
+
+// resolveCalls links the named calls in v.Instructions[start:end]. Calls and
+// tail calls to a builtin the sandbox allows become CALL_NATIVE with the
+// builtin's index. With direct set, calls to a global the code assigns
+// exactly once, from a function definition, become CALL_DIRECT to the
+// function's entry. A call can still run before the definition does, and
+// the host can assign the global afterwards, so CALL_DIRECT only jumps while
+// the definition is the last store to the global. Calls to globals that are
+// reassigned, or that only the host sets, stay CALL and are looked up when
+// they run.
+func (v *VM) resolveCalls(start int, end int, direct bool) {
+	code := v.Instructions[start:end]
+	defs := make(map[string]int)
+	stores := make(map[string]int)
+	if direct {
+		for i, inst := range code {
+			if inst.Op != OpSetGlobal {
+				continue
+			}
+			name, _ := inst.Arg.(string)
+			stores[name]++
+			if i > 0 && code[i-1].Op == OpMakeFunc {
+				fn := v.Constants[int(toFloat64(code[i-1].Arg))]
+				defs[name] = int(toFloat64(fn.Value))
+			}
+		}
+	}
+
+	for i, inst := range code {
+		if inst.Op != OpCall && inst.Op != OpTailCall {
+			continue
+		}
+		name, _ := inst.Arg.(string)
+		if idx, ok := nativeIndex[name]; ok {
+			if !v.Denied[name] {
+				code[i] = Instruction{Op: OpCallNative, Arg: float64(idx), Line: inst.Line}
+			}
+			continue
+		}
+		// A tail call keeps its opcode, it already jumps straight into the
+		// function once it has seen it.
+		if entry, ok := defs[name]; ok && stores[name] == 1 && inst.Op == OpCall {
+			defined := v.globalGen[v.globalSlot(name)] + 1
+			code[i] = Instruction{Op: OpCallDirect, Arg: directCall{entry, name, defined}, Line: inst.Line}
+		}
+	}
+}
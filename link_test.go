@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"lightlang/builtins"
+	"testing"
+)
+
+// A call linked straight to a function's entry must notice when the host
+// assigns the global afterwards and call the new value instead.
+func TestCallDirectAfterSetGlobal(t *testing.T) {
+	source := `func twice(n)
+  return n * 2
+end
+func triple(n)
+  return n * 3
+end
+func apply(n)
+  return twice(n) + 1
+end
+print(apply(5))
+`
+	instructions, constants, _, err := Compile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	prev := builtins.Output
+	builtins.Output = &out
+	defer func() { builtins.Output = prev }()
+
+	vm := NewVM()
+	vm.Instructions, vm.Constants = instructions, constants
+	if err := vm.Run(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "11\n" {
+		t.Fatalf("printed %q, want %q", got, "11\n")
+	}
+	linked := false
+	for _, inst := range vm.Instructions {
+		if call, ok := inst.Arg.(directCall); ok && inst.Op == OpCallDirect && call.name == "twice" {
+			linked = true
+		}
+	}
+	if !linked {
+		t.Fatal("the call to twice wasn't linked to its entry")
+	}
+
+	triple, _ := vm.GetGlobal("triple")
+	apply, _ := vm.GetGlobal("apply")
+	vm.SetGlobal("twice", triple)
+	res, err := vm.CallFunction(apply, []Value{builtins.Number(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.Num(); n != 16 {
+		t.Errorf("apply(5) returned %v after twice was replaced, want 16", res)
+	}
+}
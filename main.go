@@ -3,46 +3,121 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func buildCommand(source string, output string) {
-	content, err := os.ReadFile(source)
+func buildCommand(sources []string, output string, searchPath []string, opts WriteOptions, opt OptOptions) {
+	instructions, constants, modules, err := BuildImage(sources[0], sources[1:], searchPath, opt)
 	if err != nil {
-		fmt.Printf("Error reading source file: %v\n", err)
+		fmt.Println(err)
 		return
 	}
 
-	nodes, err := Parse(string(content))
-	if err != nil {
-		fmt.Printf("Parse Error: %v\n", err)
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		fmt.Printf("Error writing bytecode file: %v\n", err)
 		return
 	}
-
-	builder := NewBuilder()
-	for _, node := range nodes {
-		if err := node.TypeCheck(builder.SymbolTable); err != nil {
-			fmt.Printf("Type Error: %v\n", err)
-			return
-		}
-		node.Emit(builder)
+	img := &Image{
+		Instructions: instructions,
+		Constants:    constants,
+		Modules:      modules,
+		Meta:         map[string]string{"compiler": "lightlang"},
 	}
-	builder.Emit(OpHalt, nil)
-
-	instructions, constants := builder.Bytecode()
-	instructions, constants = OptimizeBytecode(instructions, constants, builder.SymbolTable)
-
-	err = SaveBytecode(output, instructions, constants)
-	if err != nil {
+	if !opts.Strip {
+		img.Meta["source"] = sources[0]
+	}
+	if err := SaveFile(output, img, opts); err != nil {
 		fmt.Printf("Error writing bytecode file: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Successfully built '%s' -> '%s'\n", source, output)
+	if len(modules) > 1 {
+		fmt.Printf("Successfully built '%s' with %d modules -> '%s'\n", sources[0], len(modules)-1, output)
+		return
+	}
+	fmt.Printf("Successfully built '%s' -> '%s'\n", sources[0], output)
 }
 
-func runFile(target string) {
+// parseBuildArgs accepts `[-o output] [--strip] [--compress] <entry.ll>
+// [module.ll...]` as well as the older `<source.ll> <output.llbytecode>` form.
+func parseBuildArgs(args []string) ([]string, string, WriteOptions, error) {
+	var sources []string
+	var opts WriteOptions
+	output := ""
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-o":
+			if i+1 >= len(args) {
+				return nil, "", opts, fmt.Errorf("-o needs an output file")
+			}
+			output = args[i+1]
+			i++
+		case "--strip":
+			opts.Strip = true
+		case "--compress":
+			opts.Compress = true
+		default:
+			sources = append(sources, args[i])
+		}
+	}
+	if len(sources) == 0 {
+		return nil, output, opts, nil
+	}
+	if output == "" && len(sources) == 2 && strings.HasSuffix(sources[1], ".llbytecode") {
+		output = sources[1]
+		sources = sources[:1]
+	}
+	if output == "" {
+		output = strings.TrimSuffix(sources[0], filepath.Ext(sources[0])) + ".llbytecode"
+	}
+	return sources, output, opts, nil
+}
+
+// optFlags takes the optimizer flags out of args. -O0, -O1 and -O2 pick a
+// level, -O2 being the default, --passes=fold,dce runs just the passes listed,
+// --no-rename keeps global names whatever else is set and --opt-report prints
+// what each pass changed to stderr.
+func optFlags(args []string) (OptOptions, []string, error) {
+	opt := OptLevel(2)
+	var rest []string
+	passes, hasPasses := "", false
+	noRename, report := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "-O0" || arg == "-O1" || arg == "-O2":
+			opt = OptLevel(int(arg[2] - '0'))
+		case strings.HasPrefix(arg, "--passes="):
+			passes, hasPasses = strings.TrimPrefix(arg, "--passes="), true
+		case arg == "--no-rename":
+			noRename = true
+		case arg == "--opt-report":
+			report = true
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if hasPasses {
+		if err := opt.SetPasses(passes); err != nil {
+			return opt, nil, err
+		}
+	}
+	if noRename {
+		opt.Rename = false
+	}
+	if report {
+		opt.Report = os.Stderr
+	}
+	return opt, rest, nil
+}
+
+func runFile(target string, manifest *Manifest, opt OptOptions) {
 	vm := NewVM()
+	vm.File = target
+	if manifest != nil {
+		manifest.Configure(vm)
+	}
 
 	if strings.HasSuffix(target, ".ll") {
 		content, err := os.ReadFile(target)
@@ -51,25 +126,13 @@ func runFile(target string) {
 			return
 		}
 
-		nodes, err := Parse(string(content))
+		instructions, constants, symbols, err := Compile(string(content))
 		if err != nil {
-			fmt.Printf("Parse Error: %v\n", err)
+			fmt.Println(err)
 			return
 		}
 
-		builder := NewBuilder()
-		for _, node := range nodes {
-			if err := node.TypeCheck(builder.SymbolTable); err != nil {
-				fmt.Printf("Type Error: %v\n", err)
-				return
-			}
-			node.Emit(builder)
-		}
-		builder.Emit(OpHalt, nil)
-
-		builder.Instructions, builder.Constants = OptimizeBytecode(builder.Instructions, builder.Constants, builder.SymbolTable)
-
-		vm.Instructions, vm.Constants = builder.Instructions, builder.Constants
+		vm.Instructions, vm.Constants = OptimizeUnit(target, instructions, constants, symbols, opt)
 
 	} else {
 		err := vm.loadBytecode(target)
@@ -84,9 +147,82 @@ func runFile(target string) {
 	}
 }
 
+func disCommand(target string) {
+	img := &Image{}
+	var err error
+	if strings.HasSuffix(target, ".ll") {
+		img.Instructions, img.Constants, img.Modules, err = BuildImage(target, nil, filepath.SplitList(os.Getenv("LIGHTLANG_PATH")), OptLevel(2))
+	} else {
+		img, err = LoadFile(target)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	keys := make([]string, 0, len(img.Meta))
+	for key := range img.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s: %s\n", key, img.Meta[key])
+	}
+	if flags := img.FlagNames(); flags != "" {
+		fmt.Printf("flags: %s\n", flags)
+	}
+	if len(keys) > 0 || img.Flags != 0 {
+		fmt.Println()
+	}
+	Disassemble(os.Stdout, img.Instructions, img.Constants, img.Modules)
+}
+
+func asmCommand(source string, output string, opts WriteOptions) {
+	content, err := os.ReadFile(source)
+	if err != nil {
+		fmt.Printf("Error reading source file: %v\n", err)
+		return
+	}
+
+	instructions, constants, err := Assemble(string(content))
+	if err != nil {
+		fmt.Printf("Assembly Error: %v\n", err)
+		return
+	}
+
+	img := &Image{
+		Instructions: instructions,
+		Constants:    constants,
+		Meta:         map[string]string{"compiler": "lightlang asm"},
+	}
+	if !opts.Strip {
+		img.Meta["source"] = source
+	}
+	if err := SaveFile(output, img, opts); err != nil {
+		fmt.Printf("Error writing bytecode file: %v\n", err)
+		return
+	}
+	fmt.Printf("Successfully assembled '%s' -> '%s'\n", source, output)
+}
+
+// projectManifest finds the manifest of the project around the working
+// directory, printing why when there is none.
+func projectManifest() *Manifest {
+	manifest, err := FindManifest(".")
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	if manifest == nil {
+		fmt.Println("No lightlang.toml or lightlang.json found, run 'lightlang init' or pass a file")
+	}
+	return manifest
+}
+
 func main() {
 	if len(os.Args) < 2 {
-		printHelp()
+		info, err := os.Stdin.Stat()
+		RunRepl(os.Stdin, os.Stdout, err == nil && info.Mode()&os.ModeCharDevice != 0)
 		return
 	}
 
@@ -97,32 +233,82 @@ func main() {
 			return
 		}
 
-		runFile(arg)
-		return
+		if arg != "run" && arg != "build" && arg != "init" && arg != "dis" && arg != "asm" {
+			runFile(arg, nil, OptLevel(2))
+			return
+		}
 	}
 
 	command := os.Args[1]
 
 	switch command {
 	case "build":
-		if len(os.Args) < 3 {
-			fmt.Println("Nope, do it like this: lightlang build <source.ll>")
+		opt, args, err := optFlags(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sources, output, opts, err := parseBuildArgs(args)
+		if err == nil && len(sources) == 0 && output == "" {
+			manifest := projectManifest()
+			if manifest == nil {
+				return
+			}
+			extra, err := manifest.SourceFiles()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts.Strip = opts.Strip || manifest.Strip
+			opts.Compress = opts.Compress || manifest.Compress
+			buildCommand(append([]string{manifest.EntryPath()}, extra...), manifest.OutputPath(), manifest.SearchPath(), opts, opt)
 			return
 		}
-		source := os.Args[2]
-		output := strings.TrimSuffix(source, ".ll") + ".llbytecode"
-		if len(os.Args) >= 4 {
-			output = os.Args[3]
+		if err != nil || len(sources) == 0 {
+			fmt.Println("Nope, do it like this: lightlang build [-o out.llbytecode] [--strip] [--compress] [-O0|-O1|-O2] [--no-rename] [--passes=fold,const,inline,rename,dce,licm,cleanup] [--opt-report] <main.ll> [module.ll...]")
+			return
 		}
-		buildCommand(source, output)
+		buildCommand(sources, output, filepath.SplitList(os.Getenv("LIGHTLANG_PATH")), opts, opt)
 
 	case "run":
+		opt, args, err := optFlags(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(args) == 0 {
+			if manifest := projectManifest(); manifest != nil {
+				runFile(manifest.EntryPath(), manifest, opt)
+			}
+			return
+		}
+		runFile(args[0], nil, opt)
+
+	case "dis":
 		if len(os.Args) < 3 {
-			fmt.Println("Nope, do it like this: lightlang run <file.ll|file.llbytecode>")
+			fmt.Println("Nope, do it like this: lightlang dis <file.ll|file.llbytecode>")
+			return
+		}
+		disCommand(os.Args[2])
+
+	case "asm":
+		sources, output, opts, err := parseBuildArgs(os.Args[2:])
+		if err != nil || len(sources) != 1 {
+			fmt.Println("Nope, do it like this: lightlang asm [-o out.llbytecode] [--strip] [--compress] <file.llasm>")
+			return
+		}
+		asmCommand(sources[0], output, opts)
+
+	case "init":
+		dir := "."
+		if len(os.Args) >= 3 {
+			dir = os.Args[2]
+		}
+		if err := InitProject(dir, ""); err != nil {
+			fmt.Println(err)
 			return
 		}
-		target := os.Args[2]
-		runFile(target)
+		fmt.Printf("Created project in '%s', start it with 'lightlang run'\n", dir)
 
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
@@ -132,7 +318,13 @@ func main() {
 
 func printHelp() {
 	fmt.Println("lightlang is a lightweight language implemented in go; portable and simple;")
-	fmt.Println("lightlang build <file.ll>	Build bytecode from source")
-	fmt.Println("lightlang run <file.ll> or <file.llbytecode>	Run source file directly or bytecode")
+	fmt.Println("lightlang build [-o out.llbytecode] [--strip] [--compress] [-O0|-O1|-O2] <main.ll> [module.ll...]	Build one bytecode image from source and its imports")
+	fmt.Println("build and run flags: -O0|-O1|-O2 --no-rename --passes=fold,const,inline,rename,dce,licm,cleanup --opt-report	Optimizer off, keeping global names, or every pass (default); pick passes; print what they changed")
+	fmt.Println("lightlang run [-O0|-O1|-O2] <file.ll> or <file.llbytecode>	Run source file directly or bytecode")
+	fmt.Println("lightlang dis <file.ll|file.llbytecode>	Show the bytecode of a program")
+	fmt.Println("lightlang asm [-o out.llbytecode] <file.llasm>	Assemble a textual instruction listing")
+	fmt.Println("lightlang init [dir]	Create a project with a lightlang.toml manifest")
+	fmt.Println("lightlang run / lightlang build	Run or build the project in the current directory")
 	fmt.Println("lightlang <file.ll|file.llbytecode>	Run file directly")
+	fmt.Println("lightlang	Start an interactive session")
 }
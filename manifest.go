@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ManifestNames are the project files looked for by `lightlang run` and
+// `lightlang build` when no file is given, in order of preference.
+var ManifestNames = []string{"lightlang.toml", "lightlang.json"}
+
+// Manifest describes a project: where its code lives, how to build it and
+// what the program is allowed to do when it runs.
+type Manifest struct {
+	Name     string   `json:"name"`
+	Entry    string   `json:"entry"`
+	Sources  []string `json:"sources"`
+	Path     []string `json:"path"`
+	Output   string   `json:"output"`
+	Strip    bool     `json:"strip"`
+	Compress bool     `json:"compress"`
+	Sandbox  struct {
+		Deny    []string `json:"deny"`
+		Imports *bool    `json:"imports"`
+	} `json:"sandbox"`
+	Limits struct {
+		Steps     int `json:"steps"`
+		CallDepth int `json:"call_depth"`
+	} `json:"limits"`
+
+	// Dir is the directory holding the manifest, all paths are relative to it.
+	Dir string `json:"-"`
+}
+
+// FindManifest looks for a manifest in dir and its parents. It returns nil
+// without an error when there is none.
+func FindManifest(dir string) (*Manifest, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		for _, name := range ManifestNames {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return LoadManifest(path)
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := content
+	if strings.HasSuffix(path, ".toml") {
+		values, err := parseTOML(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if data, err = json.Marshal(values); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if m.Dir, err = filepath.Abs(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if m.Name == "" {
+		m.Name = filepath.Base(m.Dir)
+	}
+	if m.Entry == "" {
+		m.Entry = "main.ll"
+	}
+	if m.Output == "" {
+		m.Output = m.Name + ".llbytecode"
+	}
+	return m, nil
+}
+
+func (m *Manifest) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(m.Dir, path)
+}
+
+func (m *Manifest) EntryPath() string  { return m.resolve(m.Entry) }
+func (m *Manifest) OutputPath() string { return m.resolve(m.Output) }
+
+// SearchPath lists where imports are looked up: the source directories, then
+// the manifest's module path, then LIGHTLANG_PATH.
+func (m *Manifest) SearchPath() []string {
+	var dirs []string
+	for _, dir := range append(append([]string{}, m.Sources...), m.Path...) {
+		dirs = append(dirs, m.resolve(dir))
+	}
+	return append(dirs, filepath.SplitList(os.Getenv("LIGHTLANG_PATH"))...)
+}
+
+// SourceFiles returns every .ll file under the source directories, so a build
+// bundles modules that are only reached through computed require paths.
+func (m *Manifest) SourceFiles() ([]string, error) {
+	var files []string
+	for _, dir := range m.Sources {
+		err := filepath.Walk(m.resolve(dir), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(path, ".ll") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Configure applies the manifest's sandbox and limits to vm.
+func (m *Manifest) Configure(vm *VM) {
+	vm.SearchPath = m.SearchPath()
+	if len(m.Sandbox.Deny) > 0 {
+		vm.Denied = make(map[string]bool, len(m.Sandbox.Deny))
+		for _, name := range m.Sandbox.Deny {
+			vm.Denied[name] = true
+		}
+	}
+	vm.NoImports = m.Sandbox.Imports != nil && !*m.Sandbox.Imports
+	vm.MaxSteps = m.Limits.Steps
+	vm.MaxCallDepth = m.Limits.CallDepth
+}
+
+const manifestTemplate = `name = "%s"
+entry = "main.ll"
+sources = ["lib"]
+path = []
+output = "build/%s.llbytecode"
+# drop line info and function names, and deflate the image
+strip = false
+compress = false
+
+[sandbox]
+# builtins the program may not call, e.g. ["writefile", "makedir", "gotodir"]
+deny = []
+# set to false to only allow modules bundled into the image
+imports = true
+
+[limits]
+# 0 means unlimited
+steps = 0
+call_depth = 0
+`
+
+const mainTemplate = `import "greet"
+
+print(greet.hello("%s"))
+`
+
+const libTemplate = `export func hello(name)
+    return "hello from " + name
+end
+`
+
+// InitProject scaffolds a project in dir. Existing files are never replaced.
+func InitProject(dir string, name string) error {
+	if name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		name = filepath.Base(abs)
+	}
+	for _, manifest := range ManifestNames {
+		if _, err := os.Stat(filepath.Join(dir, manifest)); err == nil {
+			return fmt.Errorf("%s already exists", filepath.Join(dir, manifest))
+		}
+	}
+
+	files := []struct{ path, content string }{
+		{"lightlang.toml", fmt.Sprintf(manifestTemplate, name, name)},
+		{"main.ll", fmt.Sprintf(mainTemplate, name)},
+		{filepath.Join("lib", "greet.ll"), libTemplate},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.path)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(file.content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTOML reads the subset of TOML used by manifests: tables, and keys set
+// to strings, numbers, booleans or single-line arrays of those.
+func parseTOML(src string) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+	for lineNo, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", lineNo+1)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			sub, ok := root[name].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				root[name] = sub
+			}
+			table = sub
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo+1)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+		value, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo+1, err)
+		}
+		table[key] = value
+	}
+	return root, nil
+}
+
+func stripTOMLComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			inString = !inString
+		case '#':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(s string) (interface{}, error) {
+	switch {
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("arrays must fit on one line")
+		}
+		items := []interface{}{}
+		for _, part := range splitTOMLArray(s[1 : len(s)-1]) {
+			item, err := parseTOMLValue(part)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	n, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %s", s)
+	}
+	return n, nil
+}
+
+func splitTOMLArray(s string) []string {
+	var parts []string
+	inString := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			inString = !inString
+		case ',':
+			if !inString {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, s[start:])
+
+	var items []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			items = append(items, part)
+		}
+	}
+	return items
+}
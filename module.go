@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"lightlang/builtins"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Module is a compiled unit linked into the VM's instruction stream. Its top
+// level code lives in [Start, End) and returns the module's export table.
+type Module struct {
+	Path    string
+	Start   int
+	End     int
+	Exports Value
+	loading bool
+}
+
+// Compile parses and builds a single source file. Every unit ends by
+// returning a table of its exported definitions, which is what importers get.
+func Compile(source string) ([]Instruction, []Constant, *SymbolTable, error) {
+	nodes, err := Parse(source)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Parse Error: %v", err)
+	}
+
+	// Top level locals, such as the counters of for loops, get their slots
+	// reserved like a function's do.
+	builder := NewBuilder()
+	builder.Emit(OpReserve, 0)
+	for _, node := range nodes {
+		if err := node.TypeCheck(builder.SymbolTable); err != nil {
+			return nil, nil, nil, fmt.Errorf("Type Error: %v", err)
+		}
+		node.Emit(builder)
+	}
+	builder.UpdateInstruction(0, float64(builder.SymbolTable.NextLocal))
+
+	builder.Emit(OpTable, nil)
+	for _, name := range exportedNames(nodes) {
+		builder.Emit(OpConstant, float64(builder.AddConstant(name, "string")))
+		builder.Emit(OpGetGlobal, name)
+		builder.Emit(OpSetIndex, nil)
+	}
+	builder.Emit(OpReturn, nil)
+
+	instructions, constants := builder.Bytecode()
+	return instructions, constants, builder.SymbolTable, nil
+}
+
+func exportedNames(nodes []Node) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if n, ok := node.(*ExportNode); ok && !seen[n.Name] {
+			seen[n.Name] = true
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
+
+func importAlias(spec string) (string, error) {
+	base := filepath.Base(spec)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	if !isVariable(base) {
+		return "", fmt.Errorf("cannot derive a name from import \"%s\", use 'as'", spec)
+	}
+	return base, nil
+}
+
+// resolveModule finds the file for an import, first next to the importing
+// file and then in each directory of the search path.
+func resolveModule(spec string, from string, searchPath []string) (string, error) {
+	candidates := moduleCandidates(spec)
+	dirs := []string{filepath.Dir(from)}
+	if filepath.IsAbs(spec) {
+		dirs = []string{""}
+	} else {
+		dirs = append(dirs, searchPath...)
+	}
+
+	for _, dir := range dirs {
+		for _, candidate := range candidates {
+			path := filepath.Join(dir, candidate)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				if abs, err := filepath.Abs(path); err == nil {
+					return abs, nil
+				}
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("module \"%s\" not found", spec)
+}
+
+func moduleCandidates(spec string) []string {
+	if filepath.Ext(spec) == "" {
+		return []string{spec + ".ll", spec + ".llbytecode"}
+	}
+	return []string{spec}
+}
+
+// resolveBundled looks an import up in the module table of a linked image.
+// Imports resolved at build time name their module as "/" + bundle name,
+// others follow the same rules as resolveModule with bundle names as paths.
+func (v *VM) resolveBundled(spec string, from string) (ModuleEntry, bool) {
+	if len(v.Bundle) == 0 {
+		return ModuleEntry{}, false
+	}
+	if strings.HasPrefix(spec, "/") {
+		return v.bundled(spec[1:])
+	}
+	for _, dir := range []string{filepath.Dir(from), ""} {
+		for _, candidate := range moduleCandidates(spec) {
+			if mod, ok := v.bundled(filepath.ToSlash(filepath.Join(dir, candidate))); ok {
+				return mod, true
+			}
+		}
+	}
+	return ModuleEntry{}, false
+}
+
+func (v *VM) bundled(name string) (ModuleEntry, bool) {
+	for _, mod := range v.Bundle {
+		if mod.Name == name {
+			return mod, true
+		}
+	}
+	return ModuleEntry{}, false
+}
+
+func loadModuleCode(path string) ([]Instruction, []Constant, error) {
+	if strings.HasSuffix(path, ".llbytecode") {
+		return loadVerified(path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	instructions, constants, _, err := Compile(string(content))
+	return instructions, constants, err
+}
+
+// loadVerified reads a bytecode module and checks it is safe to link.
+func loadVerified(path string) ([]Instruction, []Constant, error) {
+	instructions, constants, err := LoadBytecode(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := Verify(instructions, constants, nil); err != nil {
+		return nil, nil, err
+	}
+	return instructions, constants, nil
+}
+
+// Import loads, runs and caches the module named by spec. Relative specs are
+// resolved against the file that contains the importing code.
+func (v *VM) Import(spec string, from string) (Value, error) {
+	bundled, inBundle := v.resolveBundled(spec, from)
+	path := bundled.Name
+	if !inBundle {
+		if v.NoImports {
+			return builtins.Nil, fmt.Errorf("module \"%s\": loading files is disabled by the sandbox", spec)
+		}
+		if _, ok := v.bundled(from); ok {
+			from = filepath.Join(filepath.Dir(v.File), from)
+		}
+		var err error
+		if path, err = resolveModule(spec, from, v.SearchPath); err != nil {
+			return builtins.Nil, err
+		}
+	}
+
+	if mod, ok := v.Modules[path]; ok {
+		if mod.loading {
+			cycle := append([]string{}, v.importStack...)
+			for len(cycle) > 0 && cycle[0] != path {
+				cycle = cycle[1:]
+			}
+			cycle = append(cycle, path)
+			return builtins.Nil, fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+		return mod.Exports, nil
+	}
+
+	mod := &Module{Path: path, Start: bundled.Start, End: bundled.End, loading: true}
+	if !inBundle {
+		instructions, constants, err := loadModuleCode(path)
+		if err != nil {
+			return builtins.Nil, fmt.Errorf("module %s: %v", path, err)
+		}
+		mod.Start = v.link(instructions, constants, path+":")
+		mod.End = len(v.Instructions)
+	}
+	v.Modules[path] = mod
+	v.importStack = append(v.importStack, path)
+
+	exports, err := v.CallFunction(functionValue(float64(mod.Start)), nil)
+
+	v.importStack = v.importStack[:len(v.importStack)-1]
+	mod.loading = false
+	if err != nil {
+		delete(v.Modules, path)
+		return builtins.Nil, err
+	}
+	mod.Exports = exports
+	return exports, nil
+}
+
+// link appends a separately compiled unit to the VM and returns its entry
+// point.
+func (v *VM) link(instructions []Instruction, constants []Constant, namespace string) int {
+	codeOffset := len(v.Instructions)
+	instructions, constants = relocate(instructions, constants, codeOffset, len(v.Constants), namespace)
+	v.Constants = append(v.Constants, constants...)
+	for _, inst := range instructions {
+		v.Instructions = append(v.Instructions, inst)
+	}
+	v.resolveCalls(codeOffset, len(v.Instructions), true)
+	for _, inst := range v.Instructions[codeOffset:] {
+		v.ops = append(v.ops, v.makeOp(inst))
+	}
+	v.fuseOps(v.ops, codeOffset)
+	return codeOffset
+}
+
+// relocate prepares a separately compiled unit to be placed after codeOffset
+// instructions and constOffset constants, shifting jump targets, function
+// entries and constant indexes. Globals the unit assigns are private to it
+// and get qualified with namespace.
+func relocate(instructions []Instruction, constants []Constant, codeOffset int, constOffset int, namespace string) ([]Instruction, []Constant) {
+	defined := make(map[string]bool)
+	for _, inst := range instructions {
+		if inst.Op == OpSetGlobal {
+			defined[inst.Arg.(string)] = true
+		}
+	}
+
+	relocatedConstants := make([]Constant, len(constants))
+	for i, c := range constants {
+		if c.Type == "funcptr" {
+			c.Value = toFloat64(c.Value) + float64(codeOffset)
+		}
+		relocatedConstants[i] = c
+	}
+
+	relocated := make([]Instruction, len(instructions))
+	for i, inst := range instructions {
+		switch inst.Op {
+		case OpConstant, OpMakeFunc:
+			inst.Arg = toFloat64(inst.Arg) + float64(constOffset)
+		case OpJump, OpJumpIfFalse, OpTry:
+			if target := toFloat64(inst.Arg); target >= 0 {
+				inst.Arg = target + float64(codeOffset)
+			}
+		case OpGetGlobal, OpSetGlobal, OpCall, OpTailCall:
+			if name := inst.Arg.(string); defined[name] {
+				inst.Arg = namespace + name
+			}
+		}
+		relocated[i] = inst
+	}
+	return relocated, relocatedConstants
+}
+
+// moduleFile returns the source file of the code at ip.
+func (v *VM) moduleFile(ip int) string {
+	for _, mod := range v.Modules {
+		if ip >= mod.Start && ip < mod.End {
+			return mod.Path
+		}
+	}
+	for _, mod := range v.Bundle {
+		if ip >= mod.Start && ip < mod.End {
+			return mod.Name
+		}
+	}
+	return v.File
+}
+
+// BuildImage compiles entry and every module it imports, plus any extra
+// files, into one image. Each module is recorded in the image's module table
+// under its path relative to the entry's directory (or to the search path
+// directory it was found in), and import sites with a constant path are
+// rewritten to point at that entry. Source modules are optimized with the
+// passes opt picks.
+func BuildImage(entry string, extra []string, searchPath []string, opt OptOptions) ([]Instruction, []Constant, []ModuleEntry, error) {
+	var instructions []Instruction
+	var constants []Constant
+	var modules []ModuleEntry
+
+	root, err := filepath.Abs(filepath.Dir(entry))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	queue := []string{}
+	seen := make(map[string]bool)
+	for _, file := range append([]string{entry}, extra...) {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !seen[abs] {
+			seen[abs] = true
+			queue = append(queue, abs)
+		}
+	}
+
+	for i := 0; i < len(queue); i++ {
+		path := queue[i]
+		name, err := bundleName(path, root, searchPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		code, consts, err := compileModule(path, name, opt)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		for j, inst := range code {
+			if inst.Op != OpImport || j == 0 || code[j-1].Op != OpConstant {
+				continue
+			}
+			spec, ok := consts[int(toFloat64(code[j-1].Arg))].Value.(string)
+			if !ok {
+				continue
+			}
+			dep, err := resolveModule(spec, path, searchPath)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s: %v", path, err)
+			}
+			depName, err := bundleName(dep, root, searchPath)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			code[j-1].Arg = float64(len(consts))
+			consts = append(consts, Constant{Value: "/" + depName, Type: "string"})
+			if !seen[dep] {
+				seen[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+
+		namespace := ""
+		if i > 0 {
+			namespace = name + ":"
+		}
+		start := len(instructions)
+		code, consts = relocate(code, consts, start, len(constants), namespace)
+		instructions = append(instructions, code...)
+		constants = append(constants, consts...)
+		modules = append(modules, ModuleEntry{Name: name, Start: start, End: len(instructions)})
+	}
+
+	return instructions, constants, modules, nil
+}
+
+// compileModule loads or compiles the module at path, optimizing source with
+// the passes opt picks. name is what the report calls it.
+func compileModule(path string, name string, opt OptOptions) ([]Instruction, []Constant, error) {
+	if strings.HasSuffix(path, ".llbytecode") {
+		return loadVerified(path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	instructions, constants, symbols, err := Compile(string(content))
+	if err != nil {
+		return nil, nil, err
+	}
+	instructions, constants = OptimizeUnit(name, instructions, constants, symbols, opt)
+	return instructions, constants, nil
+}
+
+func bundleName(path string, root string, searchPath []string) (string, error) {
+	for _, dir := range append([]string{root}, searchPath...) {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(abs, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel), nil
+		}
+	}
+	return "", fmt.Errorf("%s is outside the project directory and LIGHTLANG_PATH", path)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"lightlang/builtins"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// unstable lists the scripts whose output changes from run to run: they
+// print times, random numbers or what they read.
+var unstable = map[string]bool{
+	"benchmark.ll": true,
+	"example.ll":   true,
+	"input.ll":     true,
+}
+
+func TestOptimizerKeepsScriptOutput(t *testing.T) {
+	files, err := filepath.Glob("tests/*.ll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scripts []string
+	for _, file := range files {
+		if !unstable[filepath.Base(file)] {
+			scripts = append(scripts, file)
+		}
+	}
+
+	var out bytes.Buffer
+	if !optCheck(&out, scripts, 0, 0) {
+		t.Error(out.String())
+	}
+}
+
+func TestOptimizerKeepsRandomProgramOutput(t *testing.T) {
+	var out bytes.Buffer
+	if !optCheck(&out, nil, 500, 1) {
+		t.Error(out.String())
+	}
+}
+
+// optCheck runs programs with and without the optimizer and reports every one
+// whose output differs. The programs are the given files, or when there are
+// none, n random ones from seed. Only the entry unit is compared, modules it
+// imports are optimized either way.
+func optCheck(w io.Writer, files []string, n int, seed int64) bool {
+	failed := 0
+	check := func(name, file, source string) {
+		plain, optimized, err := runBoth(source, file)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "%s: %v\n", name, err)
+		case plain != optimized:
+			fmt.Fprintf(w, "%s: output differs\n-- without optimizer:\n%s-- optimized:\n%s", name, plain, optimized)
+		default:
+			return
+		}
+		if len(files) == 0 {
+			fmt.Fprintf(w, "-- program:\n%s", source)
+		}
+		failed++
+	}
+
+	if len(files) > 0 {
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Fprintf(w, "%s: %v\n", file, err)
+				failed++
+				continue
+			}
+			check(file, file, string(content))
+		}
+		n = len(files)
+	} else {
+		r := rand.New(rand.NewSource(seed))
+		for i := 0; i < n; i++ {
+			check("program "+strconv.Itoa(i), "", randomProgram(r))
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(w, "%d of %d programs differ\n", failed, n)
+		return false
+	}
+	fmt.Fprintf(w, "no differences in %d programs\n", n)
+	return true
+}
+
+// runBoth compiles source twice, since optimizing changes the constants in
+// place, and returns what each version printed, runtime errors included.
+// Imports are found next to file.
+func runBoth(source string, file string) (string, string, error) {
+	run := func(optimize bool) (string, error) {
+		instructions, constants, symbols, err := Compile(source)
+		if err != nil {
+			return "", err
+		}
+		vm := NewVM()
+		vm.File = file
+		if optimize {
+			instructions, constants = OptimizeBytecode(instructions, constants, symbols)
+		}
+		vm.Instructions, vm.Constants = instructions, constants
+
+		var out bytes.Buffer
+		prev := builtins.Output
+		builtins.Output = &out
+		defer func() { builtins.Output = prev }()
+		if err := vm.Run(""); err != nil {
+			fmt.Fprintf(&out, "Runtime Error: %v\n", err)
+		}
+		return out.String(), nil
+	}
+
+	plain, err := run(false)
+	if err != nil {
+		return "", "", err
+	}
+	optimized, err := run(true)
+	return plain, optimized, err
+}
+
+// progGen writes random programs that always end: loops count to a small
+// bound and functions only call the ones defined before them. They lean on
+// what the optimizer touches, so they are full of constant conditions, unused
+// variables and code after return.
+type progGen struct {
+	r     *rand.Rand
+	out   strings.Builder
+	vars  [][]string
+	funcs []string
+	names int
+	depth int
+}
+
+func randomProgram(r *rand.Rand) string {
+	g := &progGen{r: r}
+	g.vars = [][]string{nil}
+	for i := r.Intn(4); i > 0; i-- {
+		g.function()
+	}
+	for i := 3 + r.Intn(8); i > 0; i-- {
+		g.statement(false)
+	}
+	return g.out.String()
+}
+
+func (g *progGen) line(format string, args ...interface{}) {
+	g.out.WriteString(strings.Repeat("  ", g.depth))
+	fmt.Fprintf(&g.out, format, args...)
+	g.out.WriteByte('\n')
+}
+
+func (g *progGen) name(prefix string) string {
+	g.names++
+	return prefix + strconv.Itoa(g.names)
+}
+
+func (g *progGen) visible() []string {
+	var names []string
+	for _, scope := range g.vars {
+		names = append(names, scope...)
+	}
+	return names
+}
+
+func (g *progGen) declare(name string) {
+	g.vars[len(g.vars)-1] = append(g.vars[len(g.vars)-1], name)
+}
+
+func (g *progGen) function() {
+	name := g.name("f")
+	g.line("func %s(a, b)", name)
+	saved := g.vars
+	g.vars = [][]string{{"a", "b"}}
+	g.depth++
+	for i := 1 + g.r.Intn(4); i > 0; i-- {
+		g.statement(true)
+	}
+	g.line("return %s", g.expr(2))
+	if g.r.Intn(3) == 0 {
+		g.line("print(%s)", g.expr(1))
+	}
+	g.depth--
+	g.vars = saved
+	g.line("end")
+	g.funcs = append(g.funcs, name)
+}
+
+func (g *progGen) block(inFunc bool) {
+	g.depth++
+	g.vars = append(g.vars, nil)
+	for i := 1 + g.r.Intn(3); i > 0; i-- {
+		g.statement(inFunc)
+	}
+	g.vars = g.vars[:len(g.vars)-1]
+	g.depth--
+}
+
+func (g *progGen) statement(inFunc bool) {
+	nested := g.depth < 4
+	switch k := g.r.Intn(10); {
+	case k < 2:
+		name := g.name("v")
+		g.line("let %s = %s", name, g.expr(2))
+		g.declare(name)
+	case k < 4 && len(g.visible()) > 0:
+		vars := g.visible()
+		g.line("%s = %s", vars[g.r.Intn(len(vars))], g.expr(2))
+	case k < 5:
+		g.line("print(%s)", g.expr(2))
+	case k < 7 && nested:
+		g.line("if %s then", g.cond())
+		g.block(inFunc)
+		if g.r.Intn(2) == 0 {
+			g.line("else")
+			g.block(inFunc)
+		}
+		g.line("end")
+	case k < 8 && nested:
+		counter := g.name("c")
+		g.line("let %s = 0", counter)
+		g.line("while %s < %d do", counter, 1+g.r.Intn(4))
+		g.block(inFunc)
+		g.depth++
+		g.line("%s = %s + 1", counter, counter)
+		g.depth--
+		g.line("end")
+	case k < 9 && inFunc && nested:
+		g.line("if %s then", g.cond())
+		g.depth++
+		g.line("return %s", g.expr(1))
+		g.depth--
+		g.line("end")
+	default:
+		name := g.name("u")
+		g.line("let %s = %s", name, g.expr(2))
+	}
+}
+
+func (g *progGen) cond() string {
+	switch g.r.Intn(5) {
+	case 0:
+		return []string{"true", "false"}[g.r.Intn(2)]
+	case 1:
+		return fmt.Sprintf("not (%s)", g.compare())
+	case 2:
+		return fmt.Sprintf("%s and %s", g.compare(), g.compare())
+	}
+	return g.compare()
+}
+
+// compare keeps its left side simple, the parser takes `if (` as the start of
+// a parenthesized condition.
+func (g *progGen) compare() string {
+	ops := []string{"<", "<=", ">", ">=", "==", "!="}
+	return fmt.Sprintf("%s %s %s", g.expr(0), ops[g.r.Intn(len(ops))], g.expr(1))
+}
+
+func (g *progGen) expr(depth int) string {
+	vars := g.visible()
+	switch k := g.r.Intn(6); {
+	case depth > 0 && k < 2:
+		ops := []string{"+", "-", "*"}
+		return fmt.Sprintf("(%s %s %s)", g.expr(depth-1), ops[g.r.Intn(len(ops))], g.expr(depth-1))
+	case depth > 0 && k < 3 && len(g.funcs) > 0:
+		return fmt.Sprintf("%s(%s, %s)", g.funcs[g.r.Intn(len(g.funcs))], g.expr(depth-1), g.expr(depth-1))
+	case k < 5 && len(vars) > 0:
+		return vars[g.r.Intn(len(vars))]
+	}
+	return strconv.Itoa(g.r.Intn(10))
+}
@@ -1,15 +1,89 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"lightlang/builtins"
 	"math"
 	"strconv"
+	"strings"
 )
 
+// OptOptions picks the passes the optimizer runs. When Report is set, it gets
+// a summary of what each pass changed.
+type OptOptions struct {
+	Fold      bool // constant arithmetic
+	Propagate bool // constants carried into later reads of variables
+	Inline    bool // calls to small functions replaced by their code
+	Rename    bool // short names for the unit's own globals
+	DeadCode  bool // unused functions, constant branches, jumps to jumps, unreachable code
+	Hoist     bool // len() of arrays a loop doesn't change worked out before it
+	Cleanup   bool // stores to variables nothing reads
+	Report    io.Writer
+}
+
+// OptLevel returns the passes of -O0, -O1 or -O2. -O1 keeps every name, so
+// host code can still look globals up by the names the script uses.
+func OptLevel(level int) OptOptions {
+	switch level {
+	case 0:
+		return OptOptions{}
+	case 1:
+		return OptOptions{Fold: true, Propagate: true, Inline: true, DeadCode: true, Hoist: true, Cleanup: true}
+	}
+	return OptOptions{Fold: true, Propagate: true, Inline: true, Rename: true, DeadCode: true, Hoist: true, Cleanup: true}
+}
+
+// SetPasses turns on exactly the passes in a comma separated list of fold,
+// const, inline, rename, dce, licm and cleanup.
+func (opt *OptOptions) SetPasses(list string) error {
+	*opt = OptOptions{Report: opt.Report}
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "fold":
+			opt.Fold = true
+		case "const":
+			opt.Propagate = true
+		case "inline":
+			opt.Inline = true
+		case "rename":
+			opt.Rename = true
+		case "dce":
+			opt.DeadCode = true
+		case "licm":
+			opt.Hoist = true
+		case "cleanup":
+			opt.Cleanup = true
+		case "":
+		default:
+			return fmt.Errorf("unknown optimizer pass '%s', the passes are fold, const, inline, rename, dce, licm and cleanup", name)
+		}
+	}
+	return nil
+}
+
 type Optimizer struct {
 	Instructions []Instruction
 	Constants    []Constant
 	SymbolTable  *SymbolTable
+	Options      OptOptions
+
+	blocks []*block
+	stats  optStats
+}
+
+// optStats counts what the passes changed, for the report.
+type optStats struct {
+	inlined     int
+	propagated  int
+	folded      int
+	renamed     int
+	functions   int
+	branches    int
+	jumps       int
+	unreachable int
+	hoisted     int
+	stores      int
 }
 
 type globalInfo struct {
@@ -17,35 +91,103 @@ type globalInfo struct {
 	usage int
 }
 
-func NewOptimizer(instructions []Instruction, constants []Constant, sym *SymbolTable) *Optimizer {
+func NewOptimizer(instructions []Instruction, constants []Constant, sym *SymbolTable, opt OptOptions) *Optimizer {
 	return &Optimizer{
 		Instructions: instructions,
 		Constants:    constants,
 		SymbolTable:  sym,
+		Options:      opt,
 	}
 }
 
 func (o *Optimizer) Optimize() ([]Instruction, []Constant) {
 	for {
-		originalLen := len(o.Instructions)
+		o.buildBlocks()
 
-		o.doConstantFolding()
+		changed := 0
+		if o.Options.Inline {
+			inlined := o.doInlining()
+			o.stats.inlined += inlined
+			changed += inlined
+		}
 
-		o.doNameScraping()
+		if o.Options.Propagate {
+			propagated := o.doConstantPropagation()
+			o.stats.propagated += propagated
+			changed += propagated
+		}
 
-		o.doCleanup()
+		if o.Options.Fold {
+			folded := o.doConstantFolding()
+			o.stats.folded += folded
+			changed += folded
+		}
+
+		if o.Options.DeadCode {
+			changed += o.doDeadCode()
+		}
+
+		if o.Options.Hoist {
+			hoisted := o.doHoisting()
+			o.stats.hoisted += hoisted
+			changed += hoisted
+		}
+
+		if o.Options.Cleanup {
+			stores := o.doCleanup()
+			o.stats.stores += stores
+			changed += stores
+		}
 
-		if len(o.Instructions) == originalLen {
+		jumps := o.linearize(o.Options.DeadCode)
+		o.stats.jumps += jumps
+		changed += jumps
+
+		if changed == 0 {
 			break
 		}
 	}
 
+	if o.Options.Rename {
+		o.stats.renamed = o.doNameScraping()
+	}
+
 	o.doGarbageCollection()
 
 	return o.Instructions, o.Constants
 }
 
-func (o *Optimizer) doNameScraping() {
+// report writes what the passes did to unit.
+func (o *Optimizer) report(w io.Writer, unit string, before int) {
+	fmt.Fprintf(w, "%s: %d -> %d instructions\n", unit, before, len(o.Instructions))
+	lines := []struct {
+		pass string
+		n    int
+		what string
+	}{
+		{"inline", o.stats.inlined, "calls inlined"},
+		{"const", o.stats.propagated, "reads replaced by constants"},
+		{"fold", o.stats.folded, "constant expressions folded"},
+		{"dce", o.stats.functions, "unused functions removed"},
+		{"dce", o.stats.branches, "constant branches resolved"},
+		{"dce", o.stats.jumps, "jumps threaded or removed"},
+		{"dce", o.stats.unreachable, "unreachable instructions removed"},
+		{"licm", o.stats.hoisted, "len() calls moved out of loops"},
+		{"cleanup", o.stats.stores, "unused stores removed"},
+		{"rename", o.stats.renamed, "globals renamed"},
+	}
+	for _, line := range lines {
+		if line.n > 0 {
+			fmt.Fprintf(w, "  %-8s %s: %d\n", line.pass, line.what, line.n)
+		}
+	}
+}
+
+func (o *Optimizer) isExported(name string) bool {
+	return o.SymbolTable != nil && o.SymbolTable.Exports[name]
+}
+
+func (o *Optimizer) doNameScraping() int {
 	builtinlist := make(map[string]bool)
 	for name := range builtins.Builtins {
 		builtinlist[name] = true
@@ -56,6 +198,17 @@ func (o *Optimizer) doNameScraping() {
 
 	localNameMap := make(map[int]string)
 
+	// Only globals the unit assigns itself are renamed. Exported names and
+	// names owned by the host or by other units keep their spelling.
+	assigned := make(map[string]bool)
+	for _, inst := range o.Instructions {
+		if inst.Op == OpSetGlobal {
+			if name, ok := inst.Arg.(string); ok {
+				assigned[name] = true
+			}
+		}
+	}
+
 	for _, inst := range o.Instructions {
 		switch inst.Op {
 		case OpGetGlobal, OpSetGlobal:
@@ -74,7 +227,7 @@ func (o *Optimizer) doNameScraping() {
 					constantUsage[constIdx]++
 				}
 			}
-		case OpCall:
+		case OpCall, OpTailCall:
 			if target, ok := inst.Arg.(string); ok && target != "" {
 				globalUsage[target]++
 			}
@@ -87,7 +240,7 @@ func (o *Optimizer) doNameScraping() {
 
 	var globalList []globalInfo
 	for name, usage := range globalUsage {
-		if builtinlist[name] {
+		if builtinlist[name] || !assigned[name] || o.isExported(name) {
 			continue
 		}
 		globalList = append(globalList, globalInfo{name: name, usage: usage})
@@ -103,6 +256,10 @@ func (o *Optimizer) doNameScraping() {
 
 	for _, info := range globalList {
 		newName := "g" + strconv.Itoa(globalCounter)
+		for (globalUsage[newName] > 0 && !assigned[newName]) || o.isExported(newName) {
+			globalCounter++
+			newName = "g" + strconv.Itoa(globalCounter)
+		}
 		globalNameMap[info.name] = newName
 		globalCounter++
 	}
@@ -121,7 +278,7 @@ func (o *Optimizer) doNameScraping() {
 					o.Instructions[i].Arg = newName
 				}
 			}
-		case OpCall:
+		case OpCall, OpTailCall:
 			if target, ok := o.Instructions[i].Arg.(string); ok {
 				if newName, exists := globalNameMap[target]; exists {
 					o.Instructions[i].Arg = newName
@@ -155,204 +312,138 @@ func (o *Optimizer) doNameScraping() {
 			o.SymbolTable.Locals = newLocals
 		}
 	}
-}
 
-func (o *Optimizer) doConstantFolding() {
-	constantValues := make(map[string]interface{})
-	isConstant := make(map[string]bool)
+	renamed := 0
+	for oldName, newName := range globalNameMap {
+		if oldName != newName {
+			renamed++
+		}
+	}
+	return renamed
+}
 
-	constantUsed := make([]bool, len(o.Constants))
+// doConstantFolding replaces `CONSTANT; CONSTANT; op` with the result of the
+// arithmetic. The three have to sit in one block, so nothing jumps between
+// them.
+func (o *Optimizer) doConstantFolding() int {
+	folded := 0
+	for _, b := range o.blocks {
+		for i := 0; i+2 < len(b.code); i++ {
+			if b.code[i].Op != OpConstant || b.code[i+1].Op != OpConstant || !isArithmeticOp(b.code[i+2].Op) {
+				continue
+			}
 
-	for i := 0; i < len(o.Instructions); i++ {
-		inst := o.Instructions[i]
+			idx1, ok1 := b.code[i].Arg.(float64)
+			idx2, ok2 := b.code[i+1].Arg.(float64)
+			if !ok1 || !ok2 {
+				continue
+			}
 
-		if inst.Op == OpConstant {
-			if idx, ok := inst.Arg.(float64); ok {
-				constIdx := int(idx)
-				if constIdx >= 0 && constIdx < len(o.Constants) {
-					constantUsed[constIdx] = true
-				}
+			constIdx1 := int(idx1)
+			constIdx2 := int(idx2)
+			if constIdx1 < 0 || constIdx1 >= len(o.Constants) ||
+				constIdx2 < 0 || constIdx2 >= len(o.Constants) {
+				continue
 			}
-		}
 
-		if inst.Op == OpSetGlobal {
-			if name, ok := inst.Arg.(string); ok && i > 0 {
-				prev := o.Instructions[i-1]
-				if prev.Op == OpConstant {
-					if idx, ok := prev.Arg.(float64); ok {
-						constIdx := int(idx)
-						if constIdx >= 0 && constIdx < len(o.Constants) {
-							constantValues[name] = o.Constants[constIdx].Value
-							isConstant[name] = true
-						}
-					}
-				}
+			val1 := o.Constants[constIdx1].Value
+			val2 := o.Constants[constIdx2].Value
+
+			result, ok := performArithmetic(val1, val2, b.code[i+2].Op)
+			if !ok {
+				continue
 			}
-		}
-	}
 
-	for i := 0; i < len(o.Instructions); i++ {
-		if i+2 < len(o.Instructions) {
-			if o.Instructions[i].Op == OpConstant &&
-				o.Instructions[i+1].Op == OpConstant &&
-				isArithmeticOp(o.Instructions[i+2].Op) {
-
-				idx1, ok1 := o.Instructions[i].Arg.(float64)
-				idx2, ok2 := o.Instructions[i+1].Arg.(float64)
-
-				if ok1 && ok2 {
-					constIdx1 := int(idx1)
-					constIdx2 := int(idx2)
-
-					if constIdx1 >= 0 && constIdx1 < len(o.Constants) &&
-						constIdx2 >= 0 && constIdx2 < len(o.Constants) {
-
-						val1 := o.Constants[constIdx1].Value
-						val2 := o.Constants[constIdx2].Value
-
-						result, ok := performArithmetic(val1, val2, o.Instructions[i+2].Op)
-						if ok {
-							constIdx := len(o.Constants)
-							o.Constants = append(o.Constants, Constant{
-								Value: result,
-								Type:  getTypeString(result),
-							})
-
-							o.Instructions[i] = Instruction{
-								Op:   OpConstant,
-								Arg:  float64(constIdx),
-								Line: o.Instructions[i].Line,
-							}
-
-							o.Instructions = append(o.Instructions[:i+1], o.Instructions[i+3:]...)
-							i--
-						}
-					}
-				}
+			constIdx := len(o.Constants)
+			o.Constants = append(o.Constants, Constant{
+				Value: result,
+				Type:  getTypeString(result),
+			})
+
+			b.code[i] = Instruction{
+				Op:   OpConstant,
+				Arg:  float64(constIdx),
+				Line: b.code[i].Line,
 			}
+
+			b.code = append(b.code[:i+1], b.code[i+3:]...)
+			folded++
+			i--
 		}
 	}
+	return folded
 }
 
-func (o *Optimizer) doCleanup() {
+// doCleanup drops stores to variables nothing reads. A stored constant or
+// function goes with its store; any other value was computed for its side
+// effects, so it is still computed and then popped.
+func (o *Optimizer) doCleanup() int {
 	globalUsage := make(map[string]int)
 	localUsage := make(map[int]int)
 
-	for _, inst := range o.Instructions {
-		switch inst.Op {
-		case OpGetGlobal:
-			if name, ok := inst.Arg.(string); ok {
-				globalUsage[name]++
-			}
-		case OpSetGlobal:
-			if name, ok := inst.Arg.(string); ok {
-				if _, exists := globalUsage[name]; !exists {
-					globalUsage[name] = 0
+	for _, b := range o.blocks {
+		for _, inst := range b.code {
+			switch inst.Op {
+			case OpGetGlobal:
+				if name, ok := inst.Arg.(string); ok {
+					globalUsage[name]++
 				}
-			}
-		case OpGetLocal:
-			if idx, ok := inst.Arg.(float64); ok {
-				localIdx := int(idx)
-				localUsage[localIdx]++
-			}
-		case OpSetLocal:
-			if idx, ok := inst.Arg.(float64); ok {
-				localIdx := int(idx)
-				if _, exists := localUsage[localIdx]; !exists {
-					localUsage[localIdx] = 0
+			case OpSetGlobal:
+				if name, ok := inst.Arg.(string); ok {
+					if _, exists := globalUsage[name]; !exists {
+						globalUsage[name] = 0
+					}
 				}
-			}
-		case OpMakeFunc:
-			if inst.Arg != nil {
+			case OpGetLocal:
+				if idx, ok := inst.Arg.(float64); ok {
+					localUsage[int(idx)]++
+				}
+			case OpSetLocal:
 				if idx, ok := inst.Arg.(float64); ok {
-					if int(idx) < len(o.Constants) {
-						if functionConst, ok := o.Constants[int(idx)].Value.(float64); ok {
-							ip := int(functionConst)
-							if ip >= 0 && ip < len(o.Instructions) {
-								for j := ip; j < len(o.Instructions); j++ {
-									if o.Instructions[j].Op == OpReturn {
-										break
-									}
-								}
-							}
-						}
+					if _, exists := localUsage[int(idx)]; !exists {
+						localUsage[int(idx)] = 0
 					}
 				}
-			}
-		case OpCall:
-			if target, ok := inst.Arg.(string); ok {
-				if target != "" {
+			case OpCall, OpTailCall:
+				if target, ok := inst.Arg.(string); ok && target != "" {
 					globalUsage[target]++
 				}
 			}
 		}
 	}
 
-	toKeep := make([]bool, len(o.Instructions))
-	keepCount := 0
-
-	for i := 0; i < len(o.Instructions); i++ {
-		inst := o.Instructions[i]
-		keep := true
-
+	unused := func(inst Instruction) bool {
 		switch inst.Op {
 		case OpSetGlobal:
-			if name, ok := inst.Arg.(string); ok {
-				if count, exists := globalUsage[name]; exists {
-					isFuncDef := false
-					if i+1 < len(o.Instructions) && o.Instructions[i+1].Op == OpMakeFunc {
-						isFuncDef = true
-					}
-
-					if count == 0 && !isFuncDef {
-						keep = false
-						if i > 0 && o.Instructions[i-1].Op == OpConstant {
-							toKeep[i-1] = false
-						}
-					}
-				}
-			}
-
+			name, ok := inst.Arg.(string)
+			count, exists := globalUsage[name]
+			return ok && exists && count == 0 && !o.isExported(name)
 		case OpSetLocal:
-			if idx, ok := inst.Arg.(float64); ok {
-				localIdx := int(idx)
-				if count, exists := localUsage[localIdx]; exists && count == 0 {
-					keep = false
-					if i > 0 && o.Instructions[i-1].Op == OpConstant {
-						toKeep[i-1] = false
-					}
-				}
-			}
-
-		case OpMakeFunc:
-			keep = true
-
-		case OpConstant:
-			if idx, ok := inst.Arg.(float64); ok {
-				constIdx := int(idx)
-				if constIdx >= 0 && constIdx < len(o.Constants) {
-					keep = true
-				}
-			}
-
-		default:
-			keep = true
-		}
-
-		toKeep[i] = keep
-		if keep {
-			keepCount++
+			idx, ok := inst.Arg.(float64)
+			count, exists := localUsage[int(idx)]
+			return ok && exists && count == 0
 		}
+		return false
 	}
 
-	newInstructions := make([]Instruction, 0, keepCount)
-	for i, keep := range toKeep {
-		if keep {
-			newInstructions = append(newInstructions, o.Instructions[i])
+	removed := 0
+	for _, b := range o.blocks {
+		code := b.code[:0]
+		for _, inst := range b.code {
+			if !unused(inst) {
+				code = append(code, inst)
+				continue
+			}
+			removed++
+			if n := len(code); n > 0 && (code[n-1].Op == OpConstant || code[n-1].Op == OpMakeFunc) {
+				code = code[:n-1]
+				continue
+			}
+			code = append(code, Instruction{Op: OpPop, Line: inst.Line})
 		}
+		b.code = code
 	}
-
-	o.Instructions = newInstructions
+	return removed
 }
 
 func (o *Optimizer) doGarbageCollection() {
@@ -459,7 +550,8 @@ func performArithmetic(a, b interface{}, op OpCode) (interface{}, bool) {
 		return nil, false
 	}
 
-	if math.Trunc(result) == result && result >= -1<<53 && result < 1<<53 {
+	// -0 stays a float, it prints differently from 0.
+	if math.Trunc(result) == result && result >= -1<<53 && result < 1<<53 && !(result == 0 && math.Signbit(result)) {
 		return int(result), true
 	}
 
@@ -483,7 +575,18 @@ func getTypeString(val interface{}) string {
 	}
 }
 
+// OptimizeBytecode runs every pass.
 func OptimizeBytecode(instructions []Instruction, constants []Constant, sym *SymbolTable) ([]Instruction, []Constant) {
-	optimizer := NewOptimizer(instructions, constants, sym)
-	return optimizer.Optimize()
+	return OptimizeUnit("", instructions, constants, sym, OptLevel(2))
+}
+
+// OptimizeUnit runs the passes opt picks, naming the unit in the report.
+func OptimizeUnit(unit string, instructions []Instruction, constants []Constant, sym *SymbolTable, opt OptOptions) ([]Instruction, []Constant) {
+	optimizer := NewOptimizer(instructions, constants, sym, opt)
+	before := len(instructions)
+	instructions, constants = optimizer.Optimize()
+	if opt.Report != nil {
+		optimizer.report(opt.Report, unit, before)
+	}
+	return instructions, constants
 }
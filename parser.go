@@ -8,13 +8,27 @@ import (
 )
 
 type Parser struct {
-	input string
-	pos   int
-	line  int
+	input    string
+	pos      int
+	line     int
+	markPos  int
+	markLine int
 }
 
 func NewParser(input string) *Parser {
-	return &Parser{input: input, pos: 0, line: 1}
+	return &Parser{input: input, pos: 0, line: 1, markLine: 1}
+}
+
+// mark returns a node recording the source line of the statement that
+// starts at the current position. Statements come in order, so only the
+// newlines since the previous mark are counted.
+func (p *Parser) mark() Node {
+	if p.pos < p.markPos {
+		p.markPos, p.markLine = 0, 1
+	}
+	p.markLine += strings.Count(p.input[p.markPos:p.pos], "\n")
+	p.markPos = p.pos
+	return &LineNode{Line: p.markLine}
 }
 
 func Parse(source string) ([]Node, error) {
@@ -32,6 +46,7 @@ func (p *Parser) ParseProgram() ([]Node, error) {
 		if p.pos >= len(p.input) {
 			break
 		}
+		nodes = append(nodes, p.mark())
 
 		if p.matchKeyword("func") {
 			p.pos += 4
@@ -60,6 +75,25 @@ func (p *Parser) ParseProgram() ([]Node, error) {
 			nodes = append(nodes, whileNode)
 			continue
 		}
+		if p.matchKeyword("try") {
+			p.pos += 3
+			tryNode, err := p.parseTry()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, tryNode)
+			continue
+		}
+		if p.matchKeyword("import") {
+			p.pos += 6
+			importNode, err := p.parseImport()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, importNode)
+			p.consumeTerminator()
+			continue
+		}
 		if p.matchKeyword("for") {
 			p.pos += 3
 			forNode, err := p.parseForLoop()
@@ -79,6 +113,24 @@ func (p *Parser) ParseProgram() ([]Node, error) {
 			p.consumeTerminator()
 			continue
 		}
+		if p.matchKeyword("class") {
+			p.pos += 5
+			classNode, err := p.parseClass()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, classNode)
+			continue
+		}
+		if p.matchKeyword("export") {
+			p.pos += 6
+			exportNode, err := p.parseExport()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, exportNode)
+			continue
+		}
 
 		stmt, err := p.parseAssignmentOrExpr()
 		if err != nil {
@@ -92,6 +144,64 @@ func (p *Parser) ParseProgram() ([]Node, error) {
 	return nodes, nil
 }
 
+func (p *Parser) parseClass() (Node, error) {
+	// class* <name> [extends <expr>] { func <method>(<params>) <body> end } end*
+	p.skipWhitespace()
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '_') {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if !isVariable(name) {
+		return nil, fmt.Errorf("expected class name")
+	}
+
+	var base Node
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.matchKeyword("extends") {
+		p.pos += 7
+		p.skipWhitespace()
+		baseStr := p.readUntilTerminator()
+		var err error
+		base, err = parseExpression(baseStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var methods []*FuncDefNode
+	for {
+		p.skipWhitespace()
+		if p.pos >= len(p.input) {
+			return nil, fmt.Errorf("expected 'end' to close class %s", name)
+		}
+		if p.matchKeyword("end") {
+			p.pos += 3
+			break
+		}
+		if !p.matchKeyword("func") {
+			return nil, fmt.Errorf("expected method definition in class %s", name)
+		}
+		p.pos += 4
+		fnNode, err := p.parseFunctionDef()
+		if err != nil {
+			return nil, err
+		}
+		method := fnNode.(*FuncDefNode)
+		if method.Owner != nil {
+			return nil, fmt.Errorf("unexpected qualified method name in class %s", name)
+		}
+		method.Owner = &VariableNode{Name: name}
+		method.Params = append([]string{"self"}, method.Params...)
+		methods = append(methods, method)
+	}
+	p.consumeTerminator()
+
+	return &ClassNode{Name: name, Base: base, Methods: methods}, nil
+}
+
 func (p *Parser) parseLetAssignment() (Node, error) {
 	p.skipWhitespace()
 	start := p.pos
@@ -132,6 +242,22 @@ func (p *Parser) parseAssignmentOrExpr() (Node, error) {
 		if ch == ';' || ch == '\n' || ch == '\r' {
 			break
 		}
+		if ch == '"' {
+			p.pos++
+			for p.pos < len(p.input) && p.input[p.pos] != '"' && p.input[p.pos] != '\n' {
+				p.pos++
+			}
+			if p.pos < len(p.input) && p.input[p.pos] == '"' {
+				p.pos++
+			}
+			continue
+		}
+		if ch == '<' || ch == '>' || ch == '!' || ch == '~' {
+			if p.pos+1 < len(p.input) && p.input[p.pos+1] == '=' {
+				p.pos += 2
+				continue
+			}
+		}
 		if ch == '=' {
 			if p.pos+1 < len(p.input) && p.input[p.pos+1] == '=' {
 				p.pos += 2
@@ -157,42 +283,27 @@ func (p *Parser) parseAssignmentOrExpr() (Node, error) {
 		p.skipWhitespace()
 		rightStr := p.readUntilTerminator()
 
-		if strings.Contains(leftStr, "[") {
-			bracketOpen := strings.LastIndex(leftStr, "[")
-			if bracketOpen != -1 {
-				tablePart := strings.TrimSpace(leftStr[:bracketOpen])
-				insideBracket := strings.TrimSpace(leftStr[bracketOpen+1:])
-
-				bracketClose := strings.Index(insideBracket, "]")
-				if bracketClose == -1 {
-					return nil, fmt.Errorf("missing closing bracket")
-				}
-				indexPart := insideBracket[:bracketClose]
-
-				tableNode, err := parseExpression(tablePart)
-				if err != nil {
-					return nil, err
-				}
-				indexNode, err := parseExpression(indexPart)
-				if err != nil {
-					return nil, err
-				}
-				valueNode, err := parseExpression(rightStr)
-				if err != nil {
-					return nil, err
-				}
-
-				return &IndexAssignNode{
-					Table: tableNode,
-					Index: indexNode,
-					Value: valueNode,
-				}, nil
+		if !isVariable(leftStr) {
+			targetNode, err := parseExpression(leftStr)
+			if err != nil {
+				return nil, err
+			}
+			access, ok := targetNode.(*IndexAccessNode)
+			if !ok {
+				return nil, fmt.Errorf("invalid left side of assignment: %s", leftStr)
+			}
+			valueNode, err := parseExpression(rightStr)
+			if err != nil {
+				return nil, err
 			}
-		}
 
-		if !isVariable(leftStr) {
-			return nil, fmt.Errorf("invalid left side of assignment: %s", leftStr)
+			return &IndexAssignNode{
+				Table: access.Table,
+				Index: access.Index,
+				Value: valueNode,
+			}, nil
 		}
+
 		valueNode, err := parseExpression(rightStr)
 		if err != nil {
 			return nil, err
@@ -649,7 +760,7 @@ func (p *Parser) parseInForLoop() (Node, error) {
 }
 
 func (p *Parser) matchKeywordAtPos(kw string, pos int) bool {
-	if pos+len(kw) > len(p.input) {
+	if pos+len(kw) > len(p.input) || pos > 0 && isNameChar(p.input[pos-1]) {
 		return false
 	}
 	sub := p.input[pos : pos+len(kw)]
@@ -683,6 +794,154 @@ func (p *Parser) readUntil(stopChar string) string {
 	return strings.TrimSpace(result)
 }
 
+func (p *Parser) parseExport() (Node, error) {
+	// export* (let <name> = <expr> | func <name>(...) ... end | class <name> ... end | <name>)
+	p.skipWhitespace()
+	switch {
+	case p.matchKeyword("let"):
+		p.pos += 3
+		stmt, err := p.parseLetAssignment()
+		if err != nil {
+			return nil, err
+		}
+		p.consumeTerminator()
+		return &ExportNode{Decl: stmt, Name: stmt.(*AssignmentNode).Name}, nil
+	case p.matchKeyword("func"):
+		p.pos += 4
+		fnNode, err := p.parseFunctionDef()
+		if err != nil {
+			return nil, err
+		}
+		fn := fnNode.(*FuncDefNode)
+		if fn.Owner != nil {
+			return nil, fmt.Errorf("cannot export method %s, export its table instead", fn.Name)
+		}
+		return &ExportNode{Decl: fn, Name: fn.Name}, nil
+	case p.matchKeyword("class"):
+		p.pos += 5
+		classNode, err := p.parseClass()
+		if err != nil {
+			return nil, err
+		}
+		return &ExportNode{Decl: classNode, Name: classNode.(*ClassNode).Name}, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '_') {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if !isVariable(name) {
+		return nil, fmt.Errorf("expected declaration or name after export")
+	}
+	p.consumeTerminator()
+	return &ExportNode{Name: name}, nil
+}
+
+func (p *Parser) parseImport() (Node, error) {
+	// import* "<path>" [as <name>]
+	p.skipWhitespace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '"' {
+		return nil, fmt.Errorf("expected module path string after import")
+	}
+	p.pos++
+	start := p.pos
+	for p.pos < len(p.input) && p.input[p.pos] != '"' && p.input[p.pos] != '\n' {
+		p.pos++
+	}
+	if p.pos >= len(p.input) || p.input[p.pos] != '"' {
+		return nil, fmt.Errorf("unterminated module path")
+	}
+	spec := p.input[start:p.pos]
+	p.pos++
+
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+	var alias string
+	if p.matchKeyword("as") {
+		p.pos += 2
+		for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+			p.pos++
+		}
+		nameStart := p.pos
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '_') {
+			p.pos++
+		}
+		alias = p.input[nameStart:p.pos]
+		if !isVariable(alias) {
+			return nil, fmt.Errorf("expected name after 'as' in import")
+		}
+	} else {
+		var err error
+		if alias, err = importAlias(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	return &AssignmentNode{
+		Name: alias,
+		Expr: &CallNode{
+			Target:   "require",
+			Args:     []Node{&LiteralNode{Value: spec, Type: "string"}},
+			CallType: "direct",
+		},
+	}, nil
+}
+
+func (p *Parser) parseTry() (Node, error) {
+	// try* <body> [catch [<name>] <body>] [finally <body>] end*, with at least one of catch or finally
+	body, err := p.parseBlockUntil([]string{"catch", "finally", "end"})
+	if err != nil {
+		return nil, err
+	}
+	node := &TryNode{Body: body}
+
+	if p.matchKeyword("catch") {
+		p.pos += 5
+		node.HasCatch = true
+		for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+			p.pos++
+		}
+		start := p.pos
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '_') {
+			p.pos++
+		}
+		if start < p.pos {
+			node.CatchVar = p.input[start:p.pos]
+			if !isVariable(node.CatchVar) {
+				return nil, fmt.Errorf("invalid catch variable: %s", node.CatchVar)
+			}
+		}
+		node.CatchBody, err = p.parseBlockUntil([]string{"finally", "end"})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.matchKeyword("finally") {
+		p.pos += 7
+		node.FinallyBody, err = p.parseBlockUntil([]string{"end"})
+		if err != nil {
+			return nil, err
+		}
+		if node.FinallyBody == nil {
+			node.FinallyBody = []Node{}
+		}
+	}
+
+	if !node.HasCatch && node.FinallyBody == nil {
+		return nil, fmt.Errorf("expected 'catch' or 'finally' in try")
+	}
+	if !p.matchKeyword("end") {
+		return nil, fmt.Errorf("expected 'end' to close try")
+	}
+	p.pos += 3
+	p.consumeTerminator()
+
+	return node, nil
+}
+
 func (p *Parser) parseWhileLoop() (Node, error) {
 	p.skipWhitespace()
 	condStr := p.readUntilKeyword("do")
@@ -712,6 +971,26 @@ func (p *Parser) parseFunctionDef() (Node, error) {
 		p.pos++
 	}
 	name := p.input[start:p.pos]
+
+	var owner Node
+	isMethod := false
+	for p.pos < len(p.input) && (p.input[p.pos] == '.' || p.input[p.pos] == ':') && !isMethod {
+		isMethod = p.input[p.pos] == ':'
+		p.pos++
+		fieldStart := p.pos
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '_') {
+			p.pos++
+		}
+		if fieldStart == p.pos {
+			return nil, fmt.Errorf("expected field name in function definition")
+		}
+		if owner == nil {
+			owner = &VariableNode{Name: name}
+		} else {
+			owner = &IndexAccessNode{Table: owner, Index: &LiteralNode{Value: name, Type: "string"}}
+		}
+		name = p.input[fieldStart:p.pos]
+	}
 	p.skipWhitespace()
 
 	if p.pos >= len(p.input) || p.input[p.pos] != '(' {
@@ -719,6 +998,9 @@ func (p *Parser) parseFunctionDef() (Node, error) {
 	}
 	p.pos++
 	var params []string
+	if isMethod {
+		params = append(params, "self")
+	}
 
 	for {
 		p.skipWhitespace()
@@ -760,7 +1042,7 @@ func (p *Parser) parseFunctionDef() (Node, error) {
 	p.pos += 3
 	p.consumeTerminator()
 
-	return &FuncDefNode{Name: name, Params: params, Body: body}, nil
+	return &FuncDefNode{Name: name, Params: params, Body: body, Owner: owner}, nil
 }
 
 func (p *Parser) parseBlockUntil(stopKeywords []string) ([]Node, error) {
@@ -781,6 +1063,7 @@ func (p *Parser) parseBlockUntil(stopKeywords []string) ([]Node, error) {
 		if matched {
 			break
 		}
+		nodes = append(nodes, p.mark())
 
 		if p.matchKeyword("func") {
 			p.pos += 4
@@ -809,6 +1092,25 @@ func (p *Parser) parseBlockUntil(stopKeywords []string) ([]Node, error) {
 			nodes = append(nodes, whileNode)
 			continue
 		}
+		if p.matchKeyword("try") {
+			p.pos += 3
+			tryNode, err := p.parseTry()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, tryNode)
+			continue
+		}
+		if p.matchKeyword("import") {
+			p.pos += 6
+			importNode, err := p.parseImport()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, importNode)
+			p.consumeTerminator()
+			continue
+		}
 
 		if p.matchKeyword("return") {
 			p.pos += 6
@@ -888,6 +1190,16 @@ func tokenize(s string) []Token {
 			continue
 		}
 
+		// A comment runs from -- at the start or after a space to the end of
+		// the line, so a statement can carry one after its last value. Written
+		// without a space, 10--2 is still 10 minus -2, but a --b is just a.
+		if ch == '-' && i+1 < len(s) && s[i+1] == '-' && (i == 0 || strings.ContainsRune(" \t\r\n", rune(s[i-1]))) {
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			continue
+		}
+
 		if ch == '"' {
 			start := i
 			i++
@@ -969,6 +1281,9 @@ func tokenize(s string) []Token {
 		case ':':
 			tokens = append(tokens, Token{Type: "COLON", Value: ":"})
 			i++
+		case '.':
+			tokens = append(tokens, Token{Type: "DOT", Value: "."})
+			i++
 		default:
 			i++
 		}
@@ -1129,25 +1444,10 @@ func (p *ExprParser) parseAccess() (Node, error) {
 	for {
 		if p.match("LPAREN") {
 			p.advance()
-			args := []Node{}
-			if !p.match("RPAREN") {
-				for {
-					arg, err := p.parseOr()
-					if err != nil {
-						return nil, err
-					}
-					args = append(args, arg)
-					if p.match("COMMA") {
-						p.advance()
-						continue
-					}
-					if p.match("RPAREN") {
-						break
-					}
-					return nil, fmt.Errorf("expecting ')' or ',' in call")
-				}
+			args, err := p.parseCallArgs()
+			if err != nil {
+				return nil, err
 			}
-			p.advance() // )
 
 			if _, ok := node.(*AnonymousFuncNode); ok {
 				node = &CallNode{
@@ -1168,6 +1468,27 @@ func (p *ExprParser) parseAccess() (Node, error) {
 			}
 			continue
 		}
+		if p.match("DOT") {
+			p.advance()
+			name := p.peek()
+			if name.Type != "WORD" && name.Type != "KW" && name.Type != "LITERAL" {
+				return nil, fmt.Errorf("expected field name after '.'")
+			}
+			p.advance()
+			node = &IndexAccessNode{Table: node, Index: &LiteralNode{Value: name.Value, Type: "string"}}
+			continue
+		}
+		if p.match("COLON") && p.pos+2 < len(p.tokens) && p.tokens[p.pos+1].Type == "WORD" && p.tokens[p.pos+2].Type == "LPAREN" {
+			p.advance()
+			method := p.advance().Value
+			p.advance() // (
+			args, err := p.parseCallArgs()
+			if err != nil {
+				return nil, err
+			}
+			node = &MethodCallNode{Receiver: node, Method: method, Args: args}
+			continue
+		}
 		if p.match("LBRACK") {
 			p.advance()
 			index, err := p.parseOr()
@@ -1186,6 +1507,29 @@ func (p *ExprParser) parseAccess() (Node, error) {
 	return node, nil
 }
 
+func (p *ExprParser) parseCallArgs() ([]Node, error) {
+	args := []Node{}
+	if !p.match("RPAREN") {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.match("COMMA") {
+				p.advance()
+				continue
+			}
+			if p.match("RPAREN") {
+				break
+			}
+			return nil, fmt.Errorf("expecting ')' or ',' in call")
+		}
+	}
+	p.advance() // )
+	return args, nil
+}
+
 func (p *ExprParser) parseBase() (Node, error) {
 	tok := p.peek()
 
@@ -1314,19 +1658,13 @@ func (p *Parser) skipWhitespace() {
 }
 
 func (p *Parser) matchKeyword(kw string) bool {
-	if p.pos+len(kw) > len(p.input) {
-		return false
-	}
-	sub := p.input[p.pos : p.pos+len(kw)]
-	if sub != kw {
-		return false
-	}
-	nextIdx := p.pos + len(kw)
-	if nextIdx >= len(p.input) {
-		return true
-	}
-	next := rune(p.input[nextIdx])
-	return !unicode.IsLetter(next) && !unicode.IsDigit(next) && next != '_'
+	return p.matchKeywordAtPos(kw, p.pos)
+}
+
+// isNameChar reports whether c can be part of a name, so a keyword next to it
+// is only part of a longer name.
+func isNameChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
 }
 
 func (p *Parser) consumeTerminator() {
@@ -1400,6 +1738,9 @@ func (p *Parser) readUntilTerminator() string {
 	return res
 }
 
+// readUntilKeyword returns the text up to kw, like the condition before then
+// or do, and moves past kw so it isn't read as a statement of the body. kw
+// inside a string or at the end of a longer name, like todo, doesn't count.
 func (p *Parser) readUntilKeyword(kw string) string {
 	start := p.pos
 	parenDepth := 0
@@ -1407,17 +1748,28 @@ func (p *Parser) readUntilKeyword(kw string) string {
 	braceDepth := 0
 
 	for p.pos < len(p.input) {
-		if p.input[p.pos] == '(' {
+		c := p.input[p.pos]
+		if c == '"' {
+			p.pos++
+			for p.pos < len(p.input) && p.input[p.pos] != '"' {
+				p.pos++
+			}
+			if p.pos < len(p.input) {
+				p.pos++
+			}
+			continue
+		}
+		if c == '(' {
 			parenDepth++
-		} else if p.input[p.pos] == ')' {
+		} else if c == ')' {
 			parenDepth--
-		} else if p.input[p.pos] == '[' {
+		} else if c == '[' {
 			bracketDepth++
-		} else if p.input[p.pos] == ']' {
+		} else if c == ']' {
 			bracketDepth--
-		} else if p.input[p.pos] == '{' {
+		} else if c == '{' {
 			braceDepth++
-		} else if p.input[p.pos] == '}' {
+		} else if c == '}' {
 			braceDepth--
 		}
 
@@ -1427,6 +1779,9 @@ func (p *Parser) readUntilKeyword(kw string) string {
 		p.pos++
 	}
 	res := strings.TrimSpace(p.input[start:p.pos])
+	if p.matchKeyword(kw) {
+		p.pos += len(kw)
+	}
 	return res
 }
 
@@ -1443,7 +1798,7 @@ func isVariable(s string) bool {
 			return false
 		}
 	}
-	kw := []string{"true", "false", "let", "while", "do", "end", "if", "then", "else", "elseif", "func", "and", "or", "not", "return", "break"}
+	kw := []string{"true", "false", "let", "while", "do", "end", "if", "then", "else", "elseif", "func", "and", "or", "not", "return", "break", "class", "try", "catch", "finally", "import", "export"}
 	for _, k := range kw {
 		if s == k {
 			return false
@@ -1453,7 +1808,7 @@ func isVariable(s string) bool {
 }
 
 func isStopKeyword(s string) bool {
-	for _, kw := range []string{"end", "else", "elseif", "while", "if", "func", "return", "break"} {
+	for _, kw := range []string{"end", "else", "elseif", "while", "if", "func", "return", "break", "catch", "finally"} {
 		if strings.HasPrefix(strings.TrimSpace(s), kw) {
 			return true
 		}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+// -- starts a comment at the start of a line or after a space, anywhere
+// else it is a minus followed by a negation.
+func TestExpressionComments(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"print(10--2)\n", "12\n"},
+		{"let x = 2 * 3 -- six\nprint(x)\n", "6\n"},
+		{"let y = 5 --no space after the dashes\nprint(y)\n", "5\n"},
+		{"print(\"a -- b\")\n", "a -- b\n"},
+		{"let a = 10\nlet b = 2\nprint(a--b, a - -b)\n", "12 12\n"},
+		{"let a = 10\nlet b = 2\nlet c = a --b\nprint(c)\n", "10\n"},
+		{"print(\"sum\") -- a comment (with brackets\n", "sum\n"},
+		{"let n = 3\nif n > 2 then -- big\n  print(n)\nend\n", "3\n"},
+	}
+	for _, tt := range tests {
+		plain, optimized, err := runBoth(tt.source, "")
+		if err != nil {
+			t.Errorf("%q: %v", tt.source, err)
+			continue
+		}
+		if plain != tt.want || optimized != tt.want {
+			t.Errorf("%q printed %q, optimized %q, want %q", tt.source, plain, optimized, tt.want)
+		}
+	}
+}
+
+// The keyword after a condition ends it, it isn't compiled as a read of a
+// global named then or do.
+func TestConditionKeywords(t *testing.T) {
+	source := `let i = 0
+while i < 2 do
+  if i == 1 then
+    print(i)
+  end
+  i = i + 1
+end
+`
+	instructions, _, _, err := Compile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, inst := range instructions {
+		if inst.Op == OpGetGlobal && (inst.Arg == "then" || inst.Arg == "do") {
+			t.Errorf("instruction %d reads the keyword %v", ip, inst.Arg)
+		}
+	}
+}
+
+// A condition ends at the first then or do that stands on its own, not one
+// inside a string, brackets or a longer name.
+func TestConditionEnds(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"elseif", "let x = 2\nif x == 1 then\n  print(\"one\")\nelseif x == 2 then\n  print(\"two\")\nelse\n  print(\"other\")\nend\n", "two\n"},
+		{"else", "let x = 3\nif x == 1 then\n  print(\"one\")\nelseif x == 2 then\n  print(\"two\")\nelse\n  print(\"other\")\nend\n", "other\n"},
+		{"name ending in do", "let todo = 0\nwhile todo < 2 do\n  todo = todo + 1\nend\nprint(todo)\n", "2\n"},
+		{"name ending in then", "let athen = 5\nif athen == 5 then\n  print(athen)\nend\n", "5\n"},
+		{"name starting with then", "let thenext = 1\nif thenext then\n  print(thenext)\nend\n", "1\n"},
+		{"keyword in a string", "let s = \"then\"\nif s == \"then\" then\n  print(s)\nend\n", "then\n"},
+		{"keyword in a table", "let t = {\"do\": 1}\nif t[\"do\"] == 1 then\n  print(\"yes\")\nend\n", "yes\n"},
+		{"call in a condition", "func small(n)\n  return n < 3\nend\nlet i = 0\nwhile small(i) do\n  i = i + 1\nend\nprint(i)\n", "3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, optimized, err := runBoth(tt.source, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plain != tt.want || optimized != tt.want {
+				t.Errorf("printed %q and %q optimized, want %q", plain, optimized, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"lightlang/builtins"
+	"os"
+	"strings"
+)
+
+const replHelp = `Enter statements or expressions, blocks continue until their 'end'.
+  :help         show this help
+  :load <file>  run a file in this session
+  :reset        forget every definition and start over
+  :dis          show the bytecode of the last input
+  :quit         leave (Ctrl-D works too)`
+
+// Repl is an interactive session. Every input is compiled onto the end of one
+// growing program, so globals, functions and classes persist between lines.
+type Repl struct {
+	vm      *VM
+	builder *Builder
+	last    int
+	out     io.Writer
+}
+
+func NewRepl(out io.Writer) *Repl {
+	r := &Repl{out: out}
+	r.Reset()
+	return r
+}
+
+func (r *Repl) Reset() {
+	r.vm = NewVM()
+	r.vm.File = "<repl>"
+	r.builder = NewBuilder()
+	r.last = 0
+}
+
+// Eval compiles and runs one complete input. When the input ends with an
+// expression its value is returned.
+func (r *Repl) Eval(source string) (Value, error) {
+	nodes, err := Parse(source)
+	if err != nil {
+		return builtins.Nil, fmt.Errorf("Parse Error: %v", err)
+	}
+
+	// Each input runs in a frame of its own, so like Compile it reserves
+	// the slots of the top level locals, such as the counters of for loops.
+	b := r.builder
+	start, constStart := len(b.Instructions), len(b.Constants)
+	b.Emit(OpReserve, 0)
+	result := false
+	for i, node := range nodes {
+		if err := node.TypeCheck(b.SymbolTable); err != nil {
+			b.Instructions, b.Constants = b.Instructions[:start], b.Constants[:constStart]
+			return builtins.Nil, fmt.Errorf("Type Error: %v", err)
+		}
+		if stmt, ok := node.(*ExprStmtNode); ok && i == len(nodes)-1 {
+			stmt.Expr.Emit(b)
+			result = true
+			continue
+		}
+		node.Emit(b)
+	}
+	if !result {
+		b.Emit(OpConstant, float64(b.AddConstant(nil, "nil")))
+	}
+	b.UpdateInstruction(start, float64(b.SymbolTable.NextLocal))
+	b.Emit(OpReturn, nil)
+	r.last = start
+
+	v := r.vm
+	v.Instructions, v.Constants = b.Instructions, b.Constants
+	first := len(v.ops)
+	// Later inputs may redefine any function, so only builtins are linked.
+	v.resolveCalls(first, len(v.Instructions), false)
+	for _, inst := range b.Instructions[first:] {
+		v.ops = append(v.ops, v.makeOp(inst))
+	}
+	v.fuseOps(v.ops, first)
+	builtins.Call = v.CallFunction
+	res, err := v.CallFunction(functionValue(float64(start)), nil)
+	if err != nil {
+		return builtins.Nil, fmt.Errorf("Runtime Error: %v", err)
+	}
+	return res, nil
+}
+
+// Disassemble writes the bytecode compiled for the last input.
+func (r *Repl) Disassemble() {
+	b := r.builder
+	disassembleCode(r.out, b.Instructions, b.Constants, nil, r.last, len(b.Instructions))
+}
+
+// unfinished reports whether source only fails to parse because it stops
+// early, like a block still waiting for its 'end' or an open bracket.
+func unfinished(source string) bool {
+	p := NewParser(source)
+	if _, err := p.ParseProgram(); err == nil {
+		return false
+	}
+	depth := 0
+	inString := false
+	for i := 0; i < len(source); i++ {
+		switch c := source[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(' || c == '{' || c == '[':
+			depth++
+		case c == ')' || c == '}' || c == ']':
+			depth--
+		}
+	}
+	if depth > 0 {
+		return true
+	}
+	p.skipWhitespace()
+	return p.pos >= len(p.input)
+}
+
+func (r *Repl) command(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case ":help", ":h":
+		fmt.Fprintln(r.out, replHelp)
+	case ":quit", ":q":
+		return false
+	case ":reset":
+		r.Reset()
+		fmt.Fprintln(r.out, "session reset")
+	case ":dis":
+		r.Disassemble()
+	case ":load":
+		if arg == "" {
+			fmt.Fprintln(r.out, "usage: :load <file>")
+			break
+		}
+		content, err := os.ReadFile(arg)
+		if err != nil {
+			fmt.Fprintf(r.out, "Error reading file: %v\n", err)
+			break
+		}
+		r.vm.File = arg
+		if _, err := r.Eval(string(content)); err != nil {
+			fmt.Fprintln(r.out, err)
+		}
+		r.vm.File = "<repl>"
+	default:
+		fmt.Fprintf(r.out, "unknown command %s, try :help\n", name)
+	}
+	return true
+}
+
+// RunRepl reads inputs from in until it ends or the user quits. Prompts are
+// only shown when prompt is set, so piped input prints just the results.
+func RunRepl(in io.Reader, out io.Writer, prompt bool) {
+	r := NewRepl(out)
+	scanner := bufio.NewScanner(in)
+	if prompt {
+		fmt.Fprintln(out, "lightlang, :help for commands")
+	}
+
+	var pending strings.Builder
+	for {
+		if prompt {
+			if pending.Len() == 0 {
+				fmt.Fprint(out, "> ")
+			} else {
+				fmt.Fprint(out, ".. ")
+			}
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Text()
+
+		if pending.Len() == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" {
+				continue
+			}
+			if strings.HasPrefix(trimmed, ":") {
+				if !r.command(trimmed) {
+					return
+				}
+				continue
+			}
+		}
+
+		pending.WriteString(line)
+		pending.WriteString("\n")
+		source := pending.String()
+		if unfinished(source) {
+			continue
+		}
+		pending.Reset()
+
+		res, err := r.Eval(source)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			continue
+		}
+		if !res.IsNil() {
+			s, err := builtins.ToString(res)
+			if err != nil {
+				fmt.Fprintf(out, "Runtime Error: %v\n", err)
+				continue
+			}
+			fmt.Fprintln(out, s)
+		}
+	}
+	if prompt {
+		fmt.Fprintln(out)
+	}
+}
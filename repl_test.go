@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"lightlang/builtins"
+	"strings"
+	"testing"
+)
+
+// Piped input prints only the results, and every input gets the local slots
+// its loops need however many came before it.
+func TestReplPipedInput(t *testing.T) {
+	input := `let total = 0
+for x in [1, 2, 3] do
+  total = total + x
+  print(x)
+end
+total
+func double(n)
+  return n * 2
+end
+double(total)
+for i = 0; i < 2; i = i + 1 do
+  print("i " + i)
+end
+let n = 0
+while n < 3 do
+  n = n + 1
+end
+n
+for k in ["a", "b"] do
+  print(k)
+end
+`
+	want := "1\n2\n3\n6\n12\ni 0\ni 1\n3\na\nb\n"
+	var out bytes.Buffer
+	prev := builtins.Output
+	builtins.Output = &out
+	defer func() { builtins.Output = prev }()
+	RunRepl(strings.NewReader(input), &out, false)
+	if got := out.String(); got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Each script in tests/ with a .out file next to it must print exactly that,
+// with and without the optimizer.
+func TestScriptOutput(t *testing.T) {
+	files, err := filepath.Glob("tests/*.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, golden := range files {
+		script := strings.TrimSuffix(golden, ".out") + ".ll"
+		t.Run(filepath.Base(script), func(t *testing.T) {
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source, err := os.ReadFile(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, optimized, err := runBoth(string(source), script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plain != string(want) {
+				t.Errorf("printed\n%s\nwant\n%s", plain, want)
+			}
+			if optimized != plain {
+				t.Errorf("optimized, printed\n%s\nwant\n%s", optimized, plain)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+class Animal
+    func constructor(name)
+        self.name = name
+    end
+    func speak()
+        return self.name + " makes a sound"
+    end
+    func describe()
+        return "I am " + self.name
+    end
+end
+
+class Dog extends Animal
+    func constructor(name, breed)
+        super(name)
+        self.breed = breed
+    end
+    func speak()
+        return super.speak() + " (woof, " + self.breed + ")"
+    end
+end
+
+class Puppy extends Dog
+    func speak()
+        return super:speak() + " *tiny*"
+    end
+end
+
+let a = Animal.new("cat")
+let d = Dog.new("rex", "lab")
+let p = Puppy.new("bit", "pug")
+print(a:speak())
+print(d:speak())
+print(d:describe())
+print(p:speak())
+print(getmetatable(p) == Puppy, p.breed)
@@ -0,0 +1,62 @@
+try
+    print("before")
+    error("boom")
+    print("not reached")
+catch e
+    print("caught: " + e)
+end
+
+func risky(n)
+    if n > 2 then
+        error({ code: n })
+    end
+    return n * 10
+end
+
+let r = pcall(risky, 1)
+print(r[0], r[1])
+r = pcall(risky, 5)
+print(r[0], r[1].code)
+
+func nested()
+    try
+        risky(3)
+    catch err
+        print("nested caught code " + err.code)
+        error("rethrown")
+    finally
+        print("nested finally")
+    end
+end
+
+try
+    nested()
+catch e2
+    print("outer caught: " + e2)
+finally
+    print("outer finally")
+end
+
+try
+    readfile("/definitely/missing.txt")
+catch e3
+    print("io error: " + split(e3, ":")[0])
+end
+
+func f2()
+    try
+        return 42
+    finally
+        print("finally runs on return too")
+    end
+end
+print(f2())
+
+try
+    let t = pcall(func() error("inner") end)
+    print(t[0], t[1])
+    error("after pcall")
+catch
+    print("caught without name")
+end
+print("done")
@@ -0,0 +1,21 @@
+-- imported by tests/modules.ll
+let count = 0
+
+export class Rect
+    func constructor(w, h)
+        count = count + 1
+        self.w = w
+        self.h = h
+    end
+    func area()
+        return self.w * self.h
+    end
+end
+
+export func square(n)
+    return Rect.new(n, n)
+end
+
+export func made()
+    return count
+end
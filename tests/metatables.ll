@@ -0,0 +1,52 @@
+let Vec = {}
+Vec.__index = Vec
+func Vec.new(x, y)
+    return setmetatable({ x: x, y: y }, Vec)
+end
+func Vec:len2()
+    return self.x * self.x + self.y * self.y
+end
+func Vec.__add(a, b)
+    return Vec.new(a.x + b.x, a.y + b.y)
+end
+func Vec.__sub(a, b)
+    return Vec.new(a.x - b.x, a.y - b.y)
+end
+func Vec.__mul(a, b)
+    return Vec.new(a.x * b, a.y * b)
+end
+func Vec.__div(a, b)
+    return Vec.new(a.x / b, a.y / b)
+end
+func Vec.__eq(a, b)
+    return a.x == b.x and a.y == b.y
+end
+func Vec.__lt(a, b)
+    return a:len2() < b:len2()
+end
+func Vec.__le(a, b)
+    return a:len2() <= b:len2()
+end
+func Vec.__tostring(v)
+    return "Vec(" + v.x + ", " + v.y + ")"
+end
+func Vec.__len(v)
+    return 2
+end
+func Vec.__call(v, s)
+    return v.x * s
+end
+let a = Vec.new(1, 2)
+let b = Vec.new(3, 4)
+print(a + b)
+print(b - a, a * 3, b / 2)
+print(a == Vec.new(1, 2), a != b, a < b, a <= b, a > b, a >= b)
+print(a:len2(), len(a), a(10))
+print("a is " + tostring(a))
+print(getmetatable(a) == Vec, getmetatable({}))
+let proxy = setmetatable({}, { __newindex: func(t, k, v) print("set " + k) end, __index: func(t, k) return k + "!" end })
+proxy.foo = 1
+print(proxy.bar)
+let fields = keys(a)
+print(len(fields), fields[0] + fields[1] == "xy" or fields[0] + fields[1] == "yx")
+print(a)
@@ -0,0 +1,27 @@
+let Point = {}
+func Point.new(x, y)
+    return { x: x, y: y, len2: Point.len2 }
+end
+func Point:len2()
+    return self.x * self.x + self.y * self.y
+end
+let p = Point.new(3, 4)
+print(p.x)
+p.x = 6
+print(p.x, p["y"])
+print(p:len2())
+print(Point.len2(p))
+let nested = { inner: { value: 1 } }
+nested.inner.value = 42
+print(nested.inner.value)
+print(date().year >= 2024)
+func setOnNil()
+    let n = nil
+    n.x = 1
+    return 7
+end
+try
+    setOnNil()
+catch e
+    print("caught: " + e)
+end
@@ -0,0 +1,23 @@
+import "lib/shapes"
+import "lib/shapes" as again
+
+let count = 100
+let r = shapes.Rect.new(2, 3)
+print("area: " + r:area())
+print("square: " + shapes.square(4):area())
+print("cached: " + (again == shapes))
+print("made: " + shapes.made() + ", ours: " + count)
+print("private: " + shapes.count)
+print("exports: " + len(keys(shapes)) + ", leaked: " + (Rect != nil or square != nil))
+
+func load(name)
+    return require(name)
+end
+print("loaded: " + (load("lib/shapes") == shapes))
+
+let missing = "lib/missing"
+try
+    require(missing)
+catch e
+    print(e)
+end
@@ -0,0 +1,38 @@
+-- Code the optimizer rewrites. `lightlang optcheck tests/optimizer.ll` runs it
+-- with and without the optimizer and compares the output.
+
+func count()
+  let unused = 5
+  let i = 0
+  while i < 3 do
+    let tmp = i * 2
+    i = i + 1
+  end
+  return i
+  print("never runs")
+end
+
+func never_called()
+  return 1
+end
+
+func one()
+  return 1
+end
+
+let waste = one()
+print(count())
+
+let k = 0
+for (j = 1; j <= 3; j = j + 1) do
+  let z = j
+  k = k + j
+end
+print(k)
+
+if false then
+  print("folded away")
+end
+if 2 > 1 then
+  print(0 * (2 - 4))
+end
@@ -0,0 +1,9 @@
+func add(a, b)
+  let sum = a + b
+  return sum
+end
+func twice(x)
+  return add(x, x)
+end
+print(add(2, 3))
+print(twice(21))
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// maxFrameLocals bounds the local slots a frame may address when it doesn't
+// start with RESERVE, like top level code and the functions of version 3
+// files. The stack is always at least this big and grows as frames need it.
+const maxFrameLocals = 1024
+
+// Verify checks a loaded program before it runs: every constant index, jump
+// target, funcptr entry and module range must be in bounds, each opcode must
+// carry the argument type the VM expects, and no path through a frame may pop
+// more values than it pushed.
+func Verify(instructions []Instruction, constants []Constant, modules []ModuleEntry) error {
+	n := len(instructions)
+
+	for i, c := range constants {
+		if err := verifyConstant(c, n); err != nil {
+			return fmt.Errorf("invalid bytecode: constant %d: %v", i, err)
+		}
+	}
+
+	targets := make(map[int]bool)
+	for ip, inst := range instructions {
+		if err := verifyArg(inst, constants, n); err != nil {
+			return fmt.Errorf("invalid bytecode at %d (%s): %v", ip, inst.Op, err)
+		}
+		if isJump(inst.Op) {
+			targets[int(toFloat64(inst.Arg))] = true
+		}
+	}
+
+	for _, mod := range modules {
+		if mod.Start < 0 || mod.Start > mod.End || mod.End > n {
+			return fmt.Errorf("invalid bytecode: module %s has range %d-%d outside the code", mod.Name, mod.Start, mod.End)
+		}
+	}
+
+	fv := &flowVerifier{instructions: instructions, constants: constants, targets: targets}
+	entries := []int{0}
+	for _, mod := range modules {
+		entries = append(entries, mod.Start)
+	}
+	for _, entry := range entries {
+		if err := fv.frame(entry); err != nil {
+			return err
+		}
+	}
+	for _, c := range constants {
+		if c.Type == "funcptr" {
+			if err := fv.frame(int(toFloat64(c.Value))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func verifyConstant(c Constant, codeLen int) error {
+	switch c.Type {
+	case "number":
+		switch c.Value.(type) {
+		case float64, int:
+			return nil
+		}
+	case "string":
+		if _, ok := c.Value.(string); ok {
+			return nil
+		}
+	case "bool":
+		if _, ok := c.Value.(bool); ok {
+			return nil
+		}
+	case "nil":
+		if c.Value == nil {
+			return nil
+		}
+	case "funcptr":
+		entry, ok := c.Value.(float64)
+		if !ok {
+			return fmt.Errorf("funcptr must be a number")
+		}
+		if entry < 0 || int(entry) >= codeLen || entry != math.Trunc(entry) {
+			return fmt.Errorf("funcptr entry %v outside the code", entry)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown constant type %q", c.Type)
+	}
+	return fmt.Errorf("%s constant holds %T", c.Type, c.Value)
+}
+
+func verifyArg(inst Instruction, constants []Constant, codeLen int) error {
+	if int(inst.Op) >= len(opNames) || opNames[inst.Op] == "" {
+		return fmt.Errorf("unknown opcode")
+	}
+
+	switch inst.Op {
+	case OpConstant, OpMakeFunc:
+		idx, err := intArg(inst)
+		if err != nil {
+			return err
+		}
+		if idx >= len(constants) {
+			return fmt.Errorf("constant index %d out of range (%d constants)", idx, len(constants))
+		}
+		if inst.Op == OpMakeFunc && constants[idx].Type != "funcptr" {
+			return fmt.Errorf("constant %d is a %s, not a funcptr", idx, constants[idx].Type)
+		}
+	case OpJump, OpJumpIfFalse, OpTry:
+		target, err := intArg(inst)
+		if err != nil {
+			return err
+		}
+		if target > codeLen {
+			return fmt.Errorf("jump target %d outside the code", target)
+		}
+	case OpGetLocal, OpSetLocal, OpReserve, OpArray:
+		if _, err := intArg(inst); err != nil {
+			return err
+		}
+	case OpCallNative, OpCallDirect:
+		return fmt.Errorf("only the VM emits this when it links code")
+	case OpGetGlobal, OpSetGlobal, OpCall, OpTailCall, OpCallMethod:
+		if _, ok := inst.Arg.(string); !ok {
+			return fmt.Errorf("needs a name, got %T", inst.Arg)
+		}
+	}
+	return nil
+}
+
+// intArg returns a non-negative whole number argument.
+func intArg(inst Instruction) (int, error) {
+	f, ok := inst.Arg.(float64)
+	if !ok {
+		return 0, fmt.Errorf("needs a number, got %T", inst.Arg)
+	}
+	if f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return 0, fmt.Errorf("argument %v out of range", f)
+	}
+	return int(f), nil
+}
+
+// flowVerifier follows every path through a frame, tracking how many values
+// the frame holds on the stack and how many try blocks it has open at each
+// instruction.
+type flowVerifier struct {
+	instructions []Instruction
+	constants    []Constant
+	targets      map[int]bool
+}
+
+func (fv *flowVerifier) frame(entry int) error {
+	type state struct{ height, tries int }
+	seen := make(map[int]state)
+	locals := maxFrameLocals
+
+	type item struct {
+		ip int
+		state
+	}
+	work := []item{{entry, state{}}}
+	for len(work) > 0 {
+		it := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		for ip, height, tries := it.ip, it.height, it.tries; ip < len(fv.instructions); {
+			if prev, ok := seen[ip]; ok {
+				if prev.height != height {
+					return fmt.Errorf("invalid bytecode at %d: stack depth %d here, %d on another path", ip, height, prev.height)
+				}
+				if prev.tries != tries {
+					return fmt.Errorf("invalid bytecode at %d: %d open try blocks here, %d on another path", ip, tries, prev.tries)
+				}
+				break
+			}
+			seen[ip] = state{height, tries}
+			inst := fv.instructions[ip]
+			fail := func(format string, args ...interface{}) error {
+				return fmt.Errorf("invalid bytecode at %d (%s): %s", ip, inst.Op, fmt.Sprintf(format, args...))
+			}
+
+			count := 0
+			switch inst.Op {
+			case OpGetLocal, OpSetLocal:
+				if slot := int(toFloat64(inst.Arg)); slot >= locals {
+					return fail("local slot %d outside the frame's %d slots", slot, locals)
+				}
+			case OpReserve:
+				if ip != entry {
+					return fail("RESERVE only belongs at the start of a function or unit")
+				}
+				locals = int(toFloat64(inst.Arg))
+				height = locals
+			case OpTry:
+				tries++
+			case OpEndTry:
+				if tries == 0 {
+					return fail("no open try block")
+				}
+				tries--
+			case OpCall, OpTailCall, OpCallIndirect, OpCallMethod:
+				var ok bool
+				if count, ok = fv.argCount(ip); !ok {
+					return fail("argument count must be a number constant right before the call")
+				}
+			}
+			pops, pushes := stackEffect(inst, count)
+
+			if height < pops {
+				return fail("stack underflow, needs %d values but the frame holds %d", pops, height)
+			}
+			height += pushes - pops
+
+			switch inst.Op {
+			case OpReturn, OpHalt, OpThrow:
+				ip = len(fv.instructions) + 1
+				continue
+			case OpJump:
+				ip = int(toFloat64(inst.Arg))
+				continue
+			case OpJumpIfFalse:
+				work = append(work, item{int(toFloat64(inst.Arg)), state{height, tries}})
+			case OpTry:
+				work = append(work, item{int(toFloat64(inst.Arg)), state{height + 1, tries - 1}})
+			}
+			ip++
+		}
+	}
+	return nil
+}
+
+// stackEffect returns how many values inst pops and pushes. count is the
+// number of arguments of a call, which pushes its result after popping them,
+// the count and for CALL_INDIRECT and CALL_METHOD the callee.
+func stackEffect(inst Instruction, count int) (pops, pushes int) {
+	switch inst.Op {
+	case OpConstant, OpGetGlobal, OpGetLocal, OpMakeFunc, OpTable:
+		return 0, 1
+	case OpAdd, OpSub, OpMul, OpDiv, OpCmpEq, OpCmpNe, OpCmpLt, OpCmpLte, OpCmpGt, OpCmpGte, OpGetIndex:
+		return 2, 1
+	case OpNot, OpImport:
+		return 1, 1
+	case OpPop, OpSetGlobal, OpSetLocal, OpJumpIfFalse, OpThrow:
+		return 1, 0
+	case OpSetIndex:
+		return 3, 1
+	case OpArray:
+		return int(toFloat64(inst.Arg)), 1
+	case OpCall, OpTailCall, OpCallNative, OpCallDirect:
+		return 1 + count, 1
+	case OpCallIndirect, OpCallMethod:
+		return 2 + count, 1
+	}
+	return 0, 0
+}
+
+// argCount reads the count pushed by the constant in front of a call.
+func (fv *flowVerifier) argCount(ip int) (int, bool) {
+	if ip == 0 || fv.targets[ip] {
+		return 0, false
+	}
+	prev := fv.instructions[ip-1]
+	if prev.Op != OpConstant {
+		return 0, false
+	}
+	c := fv.constants[int(toFloat64(prev.Arg))]
+	if c.Type != "number" {
+		return 0, false
+	}
+	count := toFloat64(c.Value)
+	if count < 0 || count != math.Trunc(count) {
+		return 0, false
+	}
+	return int(count), true
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"lightlang/builtins"
+	"strings"
+	"testing"
+)
+
+// Version 3 files come from the compiler before functions reserved their
+// locals, so their frames address slots no RESERVE announced.
+func TestRunV3Functions(t *testing.T) {
+	var out bytes.Buffer
+	prev := builtins.Output
+	builtins.Output = &out
+	defer func() { builtins.Output = prev }()
+
+	if err := NewVM().Run("tests/v3/functions.llbytecode"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "5\n42\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
+
+func num(v float64) Constant { return Constant{Value: v, Type: "number"} }
+
+// Each program is wrong in one way the verifier must catch before the VM
+// runs it.
+func TestVerifyRejects(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions []Instruction
+		constants    []Constant
+		modules      []ModuleEntry
+		want         string
+	}{
+		{
+			name:         "jump past the end",
+			instructions: []Instruction{{Op: OpJump, Arg: 5.0}, {Op: OpHalt}},
+			want:         "jump target 5 outside the code",
+		},
+		{
+			name:         "negative jump",
+			instructions: []Instruction{{Op: OpJump, Arg: -1.0}},
+			want:         "argument -1 out of range",
+		},
+		{
+			name:         "try handler past the end",
+			instructions: []Instruction{{Op: OpTry, Arg: 9.0}, {Op: OpEndTry}, {Op: OpHalt}},
+			want:         "jump target 9 outside the code",
+		},
+		{
+			name:         "constant index out of range",
+			instructions: []Instruction{{Op: OpConstant, Arg: 3.0}, {Op: OpHalt}},
+			constants:    []Constant{num(1)},
+			want:         "constant index 3 out of range (1 constants)",
+		},
+		{
+			name:         "fractional constant index",
+			instructions: []Instruction{{Op: OpConstant, Arg: 0.5}, {Op: OpHalt}},
+			constants:    []Constant{num(1)},
+			want:         "argument 0.5 out of range",
+		},
+		{
+			name:         "function from a number constant",
+			instructions: []Instruction{{Op: OpMakeFunc, Arg: 0.0}, {Op: OpHalt}},
+			constants:    []Constant{num(1)},
+			want:         "constant 0 is a number, not a funcptr",
+		},
+		{
+			name:         "funcptr outside the code",
+			instructions: []Instruction{{Op: OpHalt}},
+			constants:    []Constant{{Value: 4.0, Type: "funcptr"}},
+			want:         "funcptr entry 4 outside the code",
+		},
+		{
+			name:         "constant of the wrong type",
+			instructions: []Instruction{{Op: OpHalt}},
+			constants:    []Constant{{Value: "1", Type: "number"}},
+			want:         "number constant holds string",
+		},
+		{
+			name:         "local outside the reserved slots",
+			instructions: []Instruction{{Op: OpReserve, Arg: 1.0}, {Op: OpGetLocal, Arg: 2.0}, {Op: OpHalt}},
+			want:         "local slot 2 outside the frame's 1 slots",
+		},
+		{
+			name:         "local outside any frame",
+			instructions: []Instruction{{Op: OpSetLocal, Arg: 2048.0}, {Op: OpHalt}},
+			want:         "local slot 2048 outside the frame's 1024 slots",
+		},
+		{
+			name:         "global without a name",
+			instructions: []Instruction{{Op: OpGetGlobal, Arg: 1.0}, {Op: OpHalt}},
+			want:         "needs a name, got float64",
+		},
+		{
+			name:         "unknown opcode",
+			instructions: []Instruction{{Op: OpCode(0x7E)}},
+			want:         "unknown opcode",
+		},
+		{
+			name:         "linked call in a file",
+			instructions: []Instruction{{Op: OpCallDirect, Arg: 0.0}, {Op: OpHalt}},
+			want:         "only the VM emits this",
+		},
+		{
+			name:         "empty stack",
+			instructions: []Instruction{{Op: OpPop}, {Op: OpHalt}},
+			want:         "stack underflow, needs 1 values but the frame holds 0",
+		},
+		{
+			name: "underflow at a join",
+			instructions: []Instruction{
+				{Op: OpConstant, Arg: 0.0},
+				{Op: OpJumpIfFalse, Arg: 3.0},
+				{Op: OpJump, Arg: 3.0},
+				{Op: OpPop},
+				{Op: OpHalt},
+			},
+			constants: []Constant{{Value: true, Type: "bool"}},
+			want:      "invalid bytecode at 3 (POP): stack underflow",
+		},
+		{
+			name: "paths join at different depths",
+			instructions: []Instruction{
+				{Op: OpConstant, Arg: 0.0},
+				{Op: OpJumpIfFalse, Arg: 3.0},
+				{Op: OpConstant, Arg: 0.0},
+				{Op: OpHalt},
+			},
+			constants: []Constant{{Value: true, Type: "bool"}},
+			want:      "invalid bytecode at 3: stack depth 0 here, 1 on another path",
+		},
+		{
+			name:         "call without an argument count",
+			instructions: []Instruction{{Op: OpGetGlobal, Arg: "f"}, {Op: OpCall, Arg: "print"}, {Op: OpHalt}},
+			want:         "argument count must be a number constant right before the call",
+		},
+		{
+			name:         "end of a try that never opened",
+			instructions: []Instruction{{Op: OpEndTry}, {Op: OpHalt}},
+			want:         "no open try block",
+		},
+		{
+			name:         "reserve in the middle of a frame",
+			instructions: []Instruction{{Op: OpConstant, Arg: 0.0}, {Op: OpReserve, Arg: 1.0}, {Op: OpHalt}},
+			constants:    []Constant{num(1)},
+			want:         "RESERVE only belongs at the start",
+		},
+		{
+			name:         "module past the end",
+			instructions: []Instruction{{Op: OpHalt}},
+			modules:      []ModuleEntry{{Name: "lib", Start: 0, End: 3}},
+			want:         "module lib has range 0-3 outside the code",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.instructions, tt.constants, tt.modules)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// encodeSmall writes a short program in the version 4 layout.
+func encodeSmall(t *testing.T) []byte {
+	var buf bytes.Buffer
+	img := &Image{
+		Instructions: []Instruction{
+			{Op: OpConstant, Arg: 0.0, Line: 1},
+			{Op: OpConstant, Arg: 1.0, Line: 1},
+			{Op: OpCall, Arg: "print", Line: 1},
+			{Op: OpHalt, Line: 1},
+		},
+		Constants: []Constant{{Value: "hi", Type: "string"}, num(1)},
+	}
+	if err := NewBytecodeWriter(&buf).Write(img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// resum replaces the checksum at the end of data so a corruption reaches the
+// section readers.
+func resum(data []byte) []byte {
+	body := data[:len(data)-4]
+	binary.LittleEndian.PutUint32(data[len(body):], crc32.ChecksumIEEE(body))
+	return data
+}
+
+// sectionAt returns the offset of the length of the section with the given id.
+func sectionAt(t *testing.T, data []byte, id byte) int {
+	for pos := 6; pos < len(data)-4; {
+		size, n := binary.Uvarint(data[pos+1:])
+		if data[pos] == id {
+			return pos + 1
+		}
+		pos += 1 + n + int(size)
+	}
+	t.Fatalf("no section %d", id)
+	return 0
+}
+
+func TestReadRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, data []byte) []byte
+		want    string
+	}{
+		{"too short", func(t *testing.T, data []byte) []byte { return data[:4] }, "too short"},
+		{"bad magic", func(t *testing.T, data []byte) []byte { data[0] ^= 0xFF; return data }, "bad magic"},
+		{"unknown version", func(t *testing.T, data []byte) []byte { data[4] = 0x90; return data }, "incompatible bytecode version: 9.0"},
+		{"checksum mismatch", func(t *testing.T, data []byte) []byte { data[len(data)/2] ^= 0x01; return data }, "checksum mismatch"},
+		{"missing checksum", func(t *testing.T, data []byte) []byte { return data[:len(data)-2] }, "checksum mismatch"},
+		{"unknown flags", func(t *testing.T, data []byte) []byte { data[5] = 0x80; return resum(data) }, "unknown flags 0x80"},
+		{"section past the end", func(t *testing.T, data []byte) []byte {
+			data[sectionAt(t, data, SectionCode)] = 0x7F
+			return resum(data)
+		}, "section 5 is truncated"},
+		{"count larger than its section", func(t *testing.T, data []byte) []byte {
+			data[sectionAt(t, data, SectionCode)+1] = 0x7F
+			return resum(data)
+		}, "count 127 larger than the section"},
+		{"string index past the table", func(t *testing.T, data []byte) []byte {
+			at := sectionAt(t, data, SectionConstants)
+			data[at+3] = 0x09
+			return resum(data)
+		}, "string 9 not in the string table"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.corrupt(t, encodeSmall(t))
+			_, err := NewBytecodeReader(bytes.NewReader(data)).Read()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Cutting a file short anywhere must fail to load rather than load a part.
+func TestReadTruncated(t *testing.T) {
+	data := encodeSmall(t)
+	if _, err := NewBytecodeReader(bytes.NewReader(data)).Read(); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := NewBytecodeReader(bytes.NewReader(data[:n])).Read(); err == nil {
+			t.Errorf("loaded the first %d of %d bytes", n, len(data))
+		}
+	}
+}
@@ -3,9 +3,15 @@ package main
 import (
 	"fmt"
 	"lightlang/builtins"
+	"os"
+	"path/filepath"
 )
 
-type Table map[string]interface{}
+// Value is what the stack, globals and tables hold. Numbers and booleans are
+// stored inline, so pushing them doesn't allocate.
+type Value = builtins.Value
+
+type Table map[string]Value
 
 func NewTable() Table {
 	return make(Table)
@@ -18,25 +24,56 @@ type Frame struct {
 	ArgCount     int
 }
 
+// Handler is an active try block. When an error is raised the VM unwinds to
+// the newest handler, dropping every frame and stack slot above it.
+type Handler struct {
+	CallDepth int
+	Sp        int
+	CatchIp   int
+}
+
 type VM struct {
 	Instructions []Instruction
 	Constants    []Constant
-	Stack        []interface{}
+	Stack        []Value
 	Sp           int
 	CallStack    []Frame
-	Globals      map[string]interface{}
+	Handlers     []Handler
+	GlobalNames  []string
+	Modules      map[string]*Module
+	Bundle       []ModuleEntry
+	SearchPath   []string
+	File         string
+
+	// Sandbox and limits, usually set from a project manifest. Zero values
+	// mean no restriction.
+	Denied       map[string]bool
+	NoImports    bool
+	MaxSteps     int
+	MaxCallDepth int
+
+	ops         []opFunc
+	globals     []Value
+	globalGen   []uint64
+	globalSlots map[string]int
+	importStack []string
+	steps       int
 }
 
 func NewVM() *VM {
 	return &VM{
-		Stack:   make([]interface{}, 8192),
-		Globals: make(map[string]interface{}, 128),
-		Sp:      0,
+		Stack:       make([]Value, 8192),
+		globalSlots: make(map[string]int, 128),
+		Modules:     make(map[string]*Module),
+		SearchPath:  filepath.SplitList(os.Getenv("LIGHTLANG_PATH")),
+		Sp:          0,
 	}
 }
 
 type opFunc func(v *VM, f *Frame) error
 
+// toFloat64 reads a number out of an instruction argument or constant as the
+// compiler and loaders produce them. Script values use Value.Num instead.
 func toFloat64(val interface{}) float64 {
 	switch v := val.(type) {
 	case float64:
@@ -52,13 +89,83 @@ func toFloat64(val interface{}) float64 {
 	}
 }
 
+// constantValue turns a constant into the value OpConstant pushes. A funcptr
+// becomes its entry address.
+func constantValue(c Constant) Value {
+	switch c.Type {
+	case "number", "funcptr":
+		return builtins.Number(toFloat64(c.Value))
+	case "string":
+		s, _ := c.Value.(string)
+		return builtins.String(s)
+	case "bool":
+		b, _ := c.Value.(bool)
+		return builtins.Bool(b)
+	}
+	return builtins.Nil
+}
+
+// boolNumber is how comparisons report their result: 1 or 0.
+func boolNumber(b bool) Value {
+	if b {
+		return builtins.Number(1)
+	}
+	return builtins.Number(0)
+}
+
+// arithError reports arithmetic on values that aren't numbers and have no
+// metamethod for it.
+func arithError(event string, a, b Value) error {
+	return fmt.Errorf("cannot %s %s and %s", event[2:], a.TypeName(), b.TypeName())
+}
+
+// globalSlot returns the slot holding the named global, giving it the next
+// free one on first use. Ops resolve their names once when they are built, so
+// running code only ever indexes v.globals.
+func (v *VM) globalSlot(name string) int {
+	if slot, ok := v.globalSlots[name]; ok {
+		return slot
+	}
+	slot := len(v.GlobalNames)
+	v.globalSlots[name] = slot
+	v.GlobalNames = append(v.GlobalNames, name)
+	v.globals = append(v.globals, builtins.Nil)
+	v.globalGen = append(v.globalGen, 0)
+	return slot
+}
+
+// storeGlobal assigns a global slot, invalidating calls cached through it.
+func (v *VM) storeGlobal(slot int, val Value) {
+	v.globals[slot] = val
+	v.globalGen[slot]++
+}
+
+// SetGlobal assigns a global by name, for hosts embedding the VM.
+func (v *VM) SetGlobal(name string, val Value) {
+	v.storeGlobal(v.globalSlot(name), val)
+}
+
+// GetGlobal reads a global by name. It reports false when the global was
+// never assigned or holds nil.
+func (v *VM) GetGlobal(name string) (Value, bool) {
+	slot, ok := v.globalSlots[name]
+	if !ok {
+		return builtins.Nil, false
+	}
+	return v.globals[slot], !v.globals[slot].IsNil()
+}
+
 func (v *VM) loadBytecode(file string) error {
-	instructions, constants, err := LoadBytecode(file)
+	instructions, constants, modules, err := LoadImage(file)
 	if err != nil {
 		return err
 	}
+	if err := Verify(instructions, constants, modules); err != nil {
+		return err
+	}
 	v.Instructions = instructions
 	v.Constants = constants
+	v.Bundle = modules
 	return nil
 }
 
@@ -67,54 +174,115 @@ func (v *VM) precompile() []opFunc {
 	for i, inst := range v.Instructions {
 		ops[i] = v.makeOp(inst)
 	}
+	v.fuseOps(ops, 0)
 	return ops
 }
 
+// arithSite is what an arithmetic instruction has seen its operands be.
+type arithSite uint8
+
+const (
+	siteUnseen arithSite = iota
+	siteNumbers
+	siteStrings
+	siteOther
+)
+
+// adaptOp builds an arithmetic op with its own type feedback: it remembers
+// whether the instruction last saw two numbers, two strings (for '+' only,
+// passed as concat) or something else, and tries that case first. Every
+// other combination goes to a metamethod and then to genericHandler.
 func adaptOp(
-	genericHandler func(a, b interface{}) interface{},
+	event string,
+	genericHandler func(a, b Value) (Value, error),
 	floatHandler func(a, b float64) float64,
+	concat bool,
 ) func(v *VM, f *Frame) error {
 
-	var newfunc func(a, b interface{}) (interface{}, bool)
-
-	newfunc = func(a, b interface{}) (interface{}, bool) { return nil, false }
+	site := siteUnseen
 
 	return func(v *VM, f *Frame) error {
 		b := v.pop()
 		a := v.pop()
 
-		if res, ok := newfunc(a, b); ok {
-			v.push(res)
-			return nil
-		}
-		switch at := a.(type) {
-		case float64:
-			if bt, ok := b.(float64); ok {
-				if floatHandler != nil {
-					newfunc = func(x, y interface{}) (interface{}, bool) {
-						f1, ok1 := x.(float64)
-						f2, ok2 := y.(float64)
-						if ok1 && ok2 {
-							return floatHandler(f1, f2), true
-						}
-						return nil, false
-					}
-					v.push(floatHandler(at, bt))
+		if site == siteStrings {
+			if as, ok := a.Str(); ok {
+				if bs, ok := b.Str(); ok {
+					v.push(builtins.String(as + bs))
 					return nil
 				}
 			}
 		}
+		if at, ok := a.Num(); ok {
+			if bt, ok := b.Num(); ok {
+				site = siteNumbers
+				v.push(builtins.Number(floatHandler(at, bt)))
+				return nil
+			}
+		}
+		if concat && a.Kind() == builtins.StringKind && b.Kind() == builtins.StringKind {
+			site = siteStrings
+			as, _ := a.Str()
+			bs, _ := b.Str()
+			v.push(builtins.String(as + bs))
+			return nil
+		}
+		site = siteOther
 
-		v.push(genericHandler(a, b))
+		if res, ok, err := v.arithMeta(event, a, b); ok {
+			if err != nil {
+				return err
+			}
+			v.push(res)
+			return nil
+		}
+
+		res, err := genericHandler(a, b)
+		if err != nil {
+			return err
+		}
+		v.push(res)
 		return nil
 	}
 }
 
+// keyCache turns the index of a table access into its key. A site indexing
+// with numbers, as loops over tables do, usually asks for the same key again
+// next time, so the last conversion is kept instead of formatting it anew.
+type keyCache struct {
+	num   float64
+	key   string
+	valid bool
+}
+
+func (c *keyCache) lookup(index Value) string {
+	if s, ok := index.Str(); ok {
+		return s
+	}
+	n, ok := index.Num()
+	if !ok {
+		return index.String()
+	}
+	if !c.valid || n != c.num {
+		c.num, c.key, c.valid = n, index.String(), true
+	}
+	return c.key
+}
+
+// callCache remembers the function a named call resolved to. It stays valid
+// until the global holding the function is assigned again, which bumps the
+// slot's generation.
+type callCache struct {
+	gen   uint64
+	entry int
+	valid bool
+}
+
 func (v *VM) makeOp(inst Instruction) opFunc {
 	switch inst.Op {
 	case OpConstant:
 		idx := int(inst.Arg.(float64))
-		val := v.Constants[idx].Value
+		val := constantValue(v.Constants[idx])
 		return func(v *VM, f *Frame) error {
 			v.push(val)
 			return nil
@@ -122,203 +290,112 @@ func (v *VM) makeOp(inst Instruction) opFunc {
 
 	case OpTable:
 		return func(v *VM, f *Frame) error {
-			v.push(make(map[string]interface{}, 4))
+			v.push(builtins.TableValue(make(map[string]Value, 4)))
 			return nil
 		}
 
 	case OpArray:
 		count := int(inst.Arg.(float64))
 		return func(v *VM, f *Frame) error {
-			arr := make([]interface{}, count)
+			arr := make([]Value, count)
 			base := v.Sp - count
 			copy(arr, v.Stack[base:v.Sp])
 			v.Sp = base
-			v.push(arr)
+			v.push(builtins.ArrayValue(arr))
 			return nil
 		}
 
-	case OpCmpEq:
+	case OpCmpEq, OpCmpNe:
+		negate := inst.Op == OpCmpNe
 		return func(v *VM, f *Frame) error {
 			b := v.pop()
 			a := v.pop()
-			if a == b {
-				v.push(1.0)
-			} else {
-				v.push(0.0)
-			}
-			return nil
-		}
-
-	case OpCmpNe:
-		return func(v *VM, f *Frame) error {
-			b := v.pop()
-			a := v.pop()
-			if a != b {
-				v.push(1.0)
-			} else {
-				v.push(0.0)
+			eq, err := v.valuesEqual(a, b)
+			if err != nil {
+				return err
 			}
+			v.push(boolNumber(eq != negate))
 			return nil
 		}
 
 	case OpCmpLt:
-		return func(v *VM, f *Frame) error {
-			b := v.pop()
-			a := v.pop()
-			if af, ok1 := a.(float64); ok1 {
-				if bf, ok2 := b.(float64); ok2 {
-					if af < bf {
-						v.push(1.0)
-					} else {
-						v.push(0.0)
-					}
-					return nil
-				}
-			}
-			if toFloat64(a) < toFloat64(b) {
-				v.push(1.0)
-			} else {
-				v.push(0.0)
-			}
-			return nil
-		}
+		return compareOp("__lt", false, func(a, b float64) bool { return a < b })
+
 	case OpCmpLte:
-		return func(v *VM, f *Frame) error {
-			b := toFloat64(v.pop())
-			a := toFloat64(v.pop())
-			if a <= b {
-				v.push(1.0)
-			} else {
-				v.push(0.0)
-			}
-			return nil
-		}
+		return compareOp("__le", false, func(a, b float64) bool { return a <= b })
 
 	case OpCmpGt:
-		return func(v *VM, f *Frame) error {
-			b := toFloat64(v.pop())
-			a := toFloat64(v.pop())
-			if a > b {
-				v.push(1.0)
-			} else {
-				v.push(0.0)
-			}
-			return nil
-		}
+		return compareOp("__lt", true, func(a, b float64) bool { return a > b })
 
 	case OpCmpGte:
-		return func(v *VM, f *Frame) error {
-			b := toFloat64(v.pop())
-			a := toFloat64(v.pop())
-			if a >= b {
-				v.push(1.0)
-			} else {
-				v.push(0.0)
-			}
-			return nil
-		}
+		return compareOp("__le", true, func(a, b float64) bool { return a >= b })
 
 	case OpAdd:
-		genericAdd := func(a, b interface{}) interface{} {
-			switch av := a.(type) {
-			case float64:
-				switch bv := b.(type) {
-				case float64:
-					return av + bv
-				case int:
-					return av + float64(bv)
-				case string:
-					return fmt.Sprintf("%v%v", av, bv)
-				}
-			case int:
-				switch bv := b.(type) {
-				case float64:
-					return float64(av) + bv
-				case int:
-					return float64(av + bv)
-				case string:
-					return fmt.Sprintf("%v%v", a, b)
-				case bool:
-					return fmt.Sprintf("%v%v", a, b)
-				}
-			case string:
-				if bs, ok := b.(string); ok {
-					return av + bs
-				}
-				return fmt.Sprintf("%s%v", av, b)
-			}
-			return fmt.Sprintf("%v%v", a, b)
+		genericAdd := func(a, b Value) (Value, error) {
+			return builtins.String(a.String() + b.String()), nil
 		}
 
-		return adaptOp(genericAdd, func(a, b float64) float64 {
+		return adaptOp("__add", genericAdd, func(a, b float64) float64 {
 			return a + b
-		})
+		}, true)
 
 	case OpSub:
-		genericSub := func(a, b interface{}) interface{} {
-			return toFloat64(a) - toFloat64(b)
+		genericSub := func(a, b Value) (Value, error) {
+			return builtins.Nil, arithError("__sub", a, b)
 		}
-		return adaptOp(genericSub, func(a, b float64) float64 {
+		return adaptOp("__sub", genericSub, func(a, b float64) float64 {
 			return a - b
-		})
+		}, false)
 
 	case OpMul:
-		genericMul := func(a, b interface{}) interface{} {
-			return toFloat64(a) * toFloat64(b)
+		genericMul := func(a, b Value) (Value, error) {
+			return builtins.Nil, arithError("__mul", a, b)
 		}
-		return adaptOp(genericMul, func(a, b float64) float64 {
+		return adaptOp("__mul", genericMul, func(a, b float64) float64 {
 			return a * b
-		})
+		}, false)
 
 	case OpDiv:
 		return func(v *VM, f *Frame) error {
 			b := v.pop()
 			a := v.pop()
 
-			if af, ok1 := a.(float64); ok1 {
-				if bf, ok2 := b.(float64); ok2 {
+			if af, ok1 := a.Num(); ok1 {
+				if bf, ok2 := b.Num(); ok2 {
 					if bf == 0 {
 						return fmt.Errorf("div by zero")
 					}
-					v.push(af / bf)
+					v.push(builtins.Number(af / bf))
 					return nil
 				}
 			}
-			bf := toFloat64(b)
-			if bf == 0 {
-				return fmt.Errorf("div by zero")
+			if res, ok, err := v.arithMeta("__div", a, b); ok {
+				if err != nil {
+					return err
+				}
+				v.push(res)
+				return nil
 			}
-			af := toFloat64(a)
-			v.push(af / bf)
-			return nil
+			return arithError("__div", a, b)
 		}
 
 	case OpNot:
 		return func(v *VM, f *Frame) error {
-			val := v.pop()
-			if val == nil || val == 0.0 || val == false || val == "" {
-				v.push(1.0)
-			} else {
-				v.push(0.0)
-			}
+			v.push(boolNumber(!v.pop().Truthy()))
 			return nil
 		}
 
 	case OpSetGlobal:
-		key := inst.Arg.(string)
+		slot := v.globalSlot(inst.Arg.(string))
 		return func(v *VM, f *Frame) error {
-			v.Globals[key] = v.pop()
+			v.storeGlobal(slot, v.pop())
 			return nil
 		}
 
 	case OpGetGlobal:
-		name := inst.Arg.(string)
+		slot := v.globalSlot(inst.Arg.(string))
 		return func(v *VM, f *Frame) error {
-			if val, ok := v.Globals[name]; ok {
-				v.push(val)
-			} else {
-				v.push(nil)
-			}
+			v.push(v.globals[slot])
 			return nil
 		}
 
@@ -337,64 +414,69 @@ func (v *VM) makeOp(inst Instruction) opFunc {
 		}
 
 	case OpGetIndex:
+		var keys keyCache
 		return func(v *VM, f *Frame) error {
 			index := v.pop()
 			table := v.pop()
-			switch t := table.(type) {
-			case []interface{}:
-				i := int(toFloat64(index))
-				if i >= 0 && i < len(t) {
-					v.push(t[i])
+			if t, ok := table.Array(); ok {
+				i, ok := index.Num()
+				if ok && i >= 0 && int(i) < len(t) {
+					v.push(t[int(i)])
 				} else {
-					v.push(nil)
+					v.push(builtins.Nil)
 				}
-			case map[string]interface{}:
-				key := fmt.Sprintf("%v", index)
-				if val, ok := t[key]; ok {
-					v.push(val)
-				} else {
-					v.push(nil)
+				return nil
+			}
+			if t, ok := table.Table(); ok {
+				val, err := v.index(t, keys.lookup(index))
+				if err != nil {
+					return err
 				}
-			default:
-				v.push(nil)
+				v.push(val)
+				return nil
 			}
+			v.push(builtins.Nil)
 			return nil
 		}
 
 	case OpSetIndex:
+		var keys keyCache
 		return func(v *VM, f *Frame) error {
 			val := v.pop()
 			index := v.pop()
 			table := v.pop()
-			switch t := table.(type) {
-			case []interface{}:
-				var i int
-				switch idx := index.(type) {
-				case float64:
-					i = int(idx)
-				case int:
-					i = idx
-				default:
-					i = int(toFloat64(index))
+			if t, ok := table.Array(); ok {
+				i, ok := index.Num()
+				if !ok {
+					return fmt.Errorf("array index must be a number, got %s", index.TypeName())
 				}
-				if i >= 0 && i < len(t) {
-					t[i] = val
+				if i >= 0 && int(i) < len(t) {
+					t[int(i)] = val
 				}
-				v.push(t)
-			case map[string]interface{}:
-				key := fmt.Sprintf("%v", index)
-				t[key] = val
-				v.push(t)
+				v.push(table)
+				return nil
 			}
-			return nil
+			if t, ok := table.Table(); ok {
+				if err := v.setIndex(t, keys.lookup(index), val); err != nil {
+					return err
+				}
+				v.push(table)
+				return nil
+			}
+			return fmt.Errorf("cannot index %s", table.TypeName())
 		}
 
 	case OpCall:
 		target := inst.Arg.(string)
+		slot := v.globalSlot(target)
+		var cache callCache
 		return func(v *VM, f *Frame) error {
-			count := int(toFloat64(v.pop()))
+			count := v.popCount()
+			if v.Denied[target] {
+				return fmt.Errorf("builtin '%s' is disabled by the sandbox", target)
+			}
 			if fn, ok := builtins.Builtins[target]; ok {
-				args := make([]interface{}, count)
+				args := make([]Value, count)
 				base := v.Sp - count
 				copy(args, v.Stack[base:v.Sp])
 				v.Sp = base
@@ -402,79 +484,133 @@ func (v *VM) makeOp(inst Instruction) opFunc {
 				if err != nil {
 					return err
 				}
-				if res != nil {
-					v.push(res)
-				} else {
-					v.push(nil)
-				}
+				v.push(res)
 				return nil
 			}
-			if val, ok := v.Globals[target]; ok {
-				if fnMeta, ok := val.(map[string]interface{}); ok {
-					if t, ok := fnMeta["type"]; ok && t == "function" {
-						entry := int(fnMeta["entry"].(float64))
-						baseSp := v.Sp - count
-						v.CallStack = append(v.CallStack, Frame{
-							Instructions: v.Instructions,
-							Ip:           entry,
-							Sp:           baseSp,
-							ArgCount:     count,
-						})
-						return nil
-					}
-				}
+			if cache.valid && cache.gen == v.globalGen[slot] {
+				v.enterFunction(cache.entry, count)
+				return nil
+			}
+			fn := v.globals[slot]
+			if t, ok := fn.Table(); ok && isFunction(t) {
+				entry, _ := t["entry"].Num()
+				cache = callCache{gen: v.globalGen[slot], entry: int(entry), valid: true}
+			}
+			if v.callFunction(fn, count) {
+				return nil
 			}
 			return fmt.Errorf("function '%s' not found", target)
 		}
 
+	case OpCallNative:
+		fn := natives[int(toFloat64(inst.Arg))]
+		return func(v *VM, f *Frame) error {
+			count := v.popCount()
+			base := v.Sp - count
+			// The arguments stay on the stack while the builtin runs, so a
+			// callback it makes pushes above them.
+			res, err := fn(v.Stack[base:v.Sp])
+			if err != nil {
+				return err
+			}
+			v.Sp = base
+			v.push(res)
+			return nil
+		}
+
+	case OpCallDirect:
+		call := inst.Arg.(directCall)
+		slot := v.globalSlot(call.name)
+		byName := v.makeOp(Instruction{Op: OpCall, Arg: call.name, Line: inst.Line})
+		return func(v *VM, f *Frame) error {
+			// Before the definition has run, or once something else has
+			// assigned the global, call whatever it holds by name.
+			if v.globalGen[slot] != call.defined {
+				return byName(v, f)
+			}
+			v.enterFunction(call.entry, v.popCount())
+			return nil
+		}
+
+	case OpTailCall:
+		target := inst.Arg.(string)
+		call := v.makeOp(Instruction{Op: OpCall, Arg: target, Line: inst.Line})
+		if _, ok := builtins.Builtins[target]; ok {
+			return call
+		}
+		slot := v.globalSlot(target)
+		var cache callCache
+		return func(v *VM, f *Frame) error {
+			if !cache.valid || cache.gen != v.globalGen[slot] {
+				t, ok := v.globals[slot].Table()
+				if !ok || !isFunction(t) {
+					// Call as usual and let the RETURN after this op return.
+					return call(v, f)
+				}
+				entry, _ := t["entry"].Num()
+				cache = callCache{gen: v.globalGen[slot], entry: int(entry), valid: true}
+			}
+			// Replace the current frame: move the arguments down to where
+			// the caller's arguments started and restart at the entry.
+			count := v.popCount()
+			copy(v.Stack[f.Sp:], v.Stack[v.Sp-count:v.Sp])
+			v.Sp = f.Sp + count
+			v.dropHandlers(len(v.CallStack) - 1)
+			f.Ip = cache.entry
+			f.ArgCount = count
+			return nil
+		}
+
 	case OpCallIndirect:
 		return func(v *VM, f *Frame) error {
-			count := int(v.pop().(float64))
+			count := v.popCount()
 			val := v.pop()
-			if fnMeta, ok := val.(map[string]interface{}); ok {
-				if t, ok := fnMeta["type"]; ok && t == "function" {
-					entry := int(fnMeta["entry"].(float64))
-					baseSp := v.Sp - count
-					v.CallStack = append(v.CallStack, Frame{
-						Instructions: v.Instructions,
-						Ip:           entry,
-						Sp:           baseSp,
-						ArgCount:     count,
-					})
-					return nil
-				}
+			if v.callFunction(val, count) {
+				return nil
 			}
 			return fmt.Errorf("cannot call non-function")
 		}
 
+	case OpCallMethod:
+		method := inst.Arg.(string)
+		return func(v *VM, f *Frame) error {
+			count := v.popCount()
+			receiver := v.Stack[v.Sp-count-1]
+			var fn Value
+			if t, ok := receiver.Table(); ok {
+				var err error
+				if fn, err = v.index(t, method); err != nil {
+					return err
+				}
+			}
+			if fn.IsNil() {
+				return fmt.Errorf("method '%s' not found", method)
+			}
+			if v.callFunction(fn, count+1) {
+				return nil
+			}
+			return fmt.Errorf("'%s' is not a method", method)
+		}
+
 	case OpReturn:
 		return func(v *VM, f *Frame) error {
 			frameSp := f.Sp
-			var retVal interface{}
+			var retVal Value
 			if v.Sp > frameSp {
 				retVal = v.pop()
-			} else {
-				retVal = nil
 			}
 			v.CallStack = v.CallStack[:len(v.CallStack)-1]
-			if len(v.CallStack) > 0 {
-				v.Sp = frameSp
-				v.push(retVal)
-			} else {
-				v.Sp = 0
-			}
+			v.dropHandlers(len(v.CallStack))
+			v.Sp = frameSp
+			v.push(retVal)
 			return nil
 		}
 
 	case OpMakeFunc:
 		idx := int(inst.Arg.(float64))
-		entry := v.Constants[idx].Value
+		entry := toFloat64(v.Constants[idx].Value)
 		return func(v *VM, f *Frame) error {
-			fnObj := map[string]interface{}{
-				"type":  "function",
-				"entry": entry,
-			}
-			v.push(fnObj)
+			v.push(functionValue(entry))
 			return nil
 		}
 
@@ -488,8 +624,7 @@ func (v *VM) makeOp(inst Instruction) opFunc {
 	case OpJumpIfFalse:
 		target := int(toFloat64(inst.Arg))
 		return func(v *VM, f *Frame) error {
-			cond := v.pop()
-			if cond == nil || cond == 0.0 || cond == false || cond == "" {
+			if !v.pop().Truthy() {
 				f.Ip = target
 			}
 			return nil
@@ -503,6 +638,51 @@ func (v *VM) makeOp(inst Instruction) opFunc {
 			return nil
 		}
 
+	case OpReserve:
+		count := int(toFloat64(inst.Arg))
+		return func(v *VM, f *Frame) error {
+			for v.Sp < f.Sp+count {
+				v.push(builtins.Nil)
+			}
+			return nil
+		}
+
+	case OpTry:
+		target := int(toFloat64(inst.Arg))
+		return func(v *VM, f *Frame) error {
+			v.Handlers = append(v.Handlers, Handler{
+				CallDepth: len(v.CallStack),
+				Sp:        v.Sp,
+				CatchIp:   target,
+			})
+			return nil
+		}
+
+	case OpEndTry:
+		return func(v *VM, f *Frame) error {
+			v.Handlers = v.Handlers[:len(v.Handlers)-1]
+			return nil
+		}
+
+	case OpThrow:
+		return func(v *VM, f *Frame) error {
+			return &builtins.ScriptError{Value: v.pop()}
+		}
+
+	case OpImport:
+		return func(v *VM, f *Frame) error {
+			spec, ok := v.pop().Str()
+			if !ok {
+				return fmt.Errorf("import path must be a string")
+			}
+			exports, err := v.Import(spec, v.moduleFile(f.Ip-1))
+			if err != nil {
+				return err
+			}
+			v.push(exports)
+			return nil
+		}
+
 	case OpHalt:
 		return func(v *VM, f *Frame) error { return fmt.Errorf("_HALT_") }
 	}
@@ -510,48 +690,285 @@ func (v *VM) makeOp(inst Instruction) opFunc {
 	return func(v *VM, f *Frame) error { return nil }
 }
 
-func (v *VM) Run(file string) error {
-	if file != "" {
-		if err := v.loadBytecode(file); err != nil {
-			return err
+// compareOp builds an ordering comparison. Gt and Gte are the __lt and __le
+// metamethods with the operands swapped.
+func compareOp(event string, swap bool, cmp func(a, b float64) bool) opFunc {
+	return func(v *VM, f *Frame) error {
+		b := v.pop()
+		a := v.pop()
+		if af, ok1 := a.Num(); ok1 {
+			if bf, ok2 := b.Num(); ok2 {
+				v.push(boolNumber(cmp(af, bf)))
+				return nil
+			}
+		}
+		x, y := a, b
+		if swap {
+			x, y = b, a
 		}
+		if res, ok, err := v.compareMeta(event, x, y); ok {
+			if err != nil {
+				return err
+			}
+			v.push(res)
+			return nil
+		}
+		return fmt.Errorf("cannot compare %s and %s", a.TypeName(), b.TypeName())
 	}
-	compiledOps := v.precompile()
-	v.CallStack = []Frame{{Instructions: v.Instructions, Ip: 0, Sp: 0}}
-	for len(v.CallStack) > 0 {
-		f := &v.CallStack[len(v.CallStack)-1]
-		currentStackDepth := len(v.CallStack)
-		for f.Ip < len(compiledOps) {
-			op := compiledOps[f.Ip]
+}
+
+// functionValue makes the function object for code starting at entry.
+func functionValue(entry float64) Value {
+	return builtins.TableValue(map[string]Value{
+		"type":  builtins.String("function"),
+		"entry": builtins.Number(entry),
+	})
+}
+
+// isFunction reports whether t is a script function object.
+func isFunction(t map[string]Value) bool {
+	typ, _ := t["type"].Str()
+	return typ == "function"
+}
+
+func (v *VM) callFunction(val Value, count int) bool {
+	fnMeta, ok := val.Table()
+	if !ok {
+		return false
+	}
+	if !isFunction(fnMeta) {
+		handler := builtins.Metamethod(val, "__call")
+		if handler.IsNil() {
+			return false
+		}
+		base := v.Sp - count
+		v.push(builtins.Nil)
+		copy(v.Stack[base+1:v.Sp], v.Stack[base:v.Sp-1])
+		v.Stack[base] = val
+		return v.callFunction(handler, count+1)
+	}
+	entry, _ := fnMeta["entry"].Num()
+	v.enterFunction(int(entry), count)
+	return true
+}
+
+// enterFunction pushes the frame for a call of the code at entry with count
+// arguments on the stack.
+func (v *VM) enterFunction(entry int, count int) {
+	// A frame that doesn't reserve its locals may use up to maxFrameLocals
+	// slots, the verifier lets it.
+	if need := v.Sp - count + maxFrameLocals; need > len(v.Stack) {
+		v.grow(need)
+	}
+	v.CallStack = append(v.CallStack, Frame{
+		Instructions: v.Instructions,
+		Ip:           entry,
+		Sp:           v.Sp - count,
+		ArgCount:     count,
+	})
+}
+
+// CallFunction runs a script function to completion and returns its result.
+// It is safe to use from inside op handlers and builtins.
+func (v *VM) CallFunction(fn Value, args []Value) (Value, error) {
+	depth := len(v.CallStack)
+	sp := v.Sp
+	for _, arg := range args {
+		v.push(arg)
+	}
+	if !v.callFunction(fn, len(args)) {
+		v.Sp = sp
+		return builtins.Nil, fmt.Errorf("cannot call non-function")
+	}
+	if err := v.execute(depth); err != nil {
+		v.CallStack = v.CallStack[:depth]
+		v.dropHandlers(depth)
+		v.Sp = sp
+		return builtins.Nil, err
+	}
+	return v.pop(), nil
+}
+
+// dropHandlers discards try blocks that belong to frames above depth.
+func (v *VM) dropHandlers(depth int) {
+	for len(v.Handlers) > 0 && v.Handlers[len(v.Handlers)-1].CallDepth > depth {
+		v.Handlers = v.Handlers[:len(v.Handlers)-1]
+	}
+}
+
+// handleError unwinds to the newest try block that was entered by this
+// execute call. It reports false when the error has to be passed up.
+func (v *VM) handleError(err error, depth int) bool {
+	if len(v.Handlers) == 0 {
+		return false
+	}
+	h := v.Handlers[len(v.Handlers)-1]
+	if h.CallDepth <= depth {
+		return false
+	}
+	v.Handlers = v.Handlers[:len(v.Handlers)-1]
+	v.CallStack = v.CallStack[:h.CallDepth]
+	v.Sp = h.Sp
+	v.push(builtins.ErrorValue(err))
+	v.CallStack[h.CallDepth-1].Ip = h.CatchIp
+	return true
+}
+
+func (v *VM) index(t map[string]Value, key string) (Value, error) {
+	for depth := 0; depth < 100; depth++ {
+		if val, ok := t[key]; ok {
+			return val, nil
+		}
+		handler := builtins.Metamethod(builtins.TableValue(t), "__index")
+		if handler.IsNil() {
+			return builtins.Nil, nil
+		}
+		if h, ok := handler.Table(); ok && !isFunction(h) {
+			t = h
+			continue
+		}
+		return v.CallFunction(handler, []Value{builtins.TableValue(t), builtins.String(key)})
+	}
+	return builtins.Nil, fmt.Errorf("'__index' chain too long")
+}
+
+func (v *VM) setIndex(t map[string]Value, key string, val Value) error {
+	for depth := 0; depth < 100; depth++ {
+		if _, ok := t[key]; ok {
+			t[key] = val
+			return nil
+		}
+		handler := builtins.Metamethod(builtins.TableValue(t), "__newindex")
+		if handler.IsNil() {
+			t[key] = val
+			return nil
+		}
+		if h, ok := handler.Table(); ok && !isFunction(h) {
+			t = h
+			continue
+		}
+		_, err := v.CallFunction(handler, []Value{builtins.TableValue(t), builtins.String(key), val})
+		return err
+	}
+	return fmt.Errorf("'__newindex' chain too long")
+}
+
+func (v *VM) arithMeta(event string, a, b Value) (Value, bool, error) {
+	handler := builtins.Metamethod(a, event)
+	if handler.IsNil() {
+		handler = builtins.Metamethod(b, event)
+	}
+	if handler.IsNil() {
+		return builtins.Nil, false, nil
+	}
+	res, err := v.CallFunction(handler, []Value{a, b})
+	return res, true, err
+}
+
+func (v *VM) compareMeta(event string, a, b Value) (Value, bool, error) {
+	res, ok, err := v.arithMeta(event, a, b)
+	if !ok || err != nil {
+		return builtins.Nil, ok, err
+	}
+	return boolNumber(res.Truthy()), true, nil
+}
+
+func (v *VM) valuesEqual(a, b Value) (bool, error) {
+	if builtins.Same(a, b) {
+		return true, nil
+	}
+	if a.Kind() == builtins.TableKind && b.Kind() == builtins.TableKind {
+		if res, ok, err := v.compareMeta("__eq", a, b); ok {
+			return res.Truthy(), err
+		}
+	}
+	return false, nil
+}
+
+func (v *VM) execute(depth int) error {
+	for len(v.CallStack) > depth {
+		if v.MaxCallDepth > 0 && len(v.CallStack) > v.MaxCallDepth {
+			v.CallStack = v.CallStack[:len(v.CallStack)-1]
+			err := fmt.Errorf("call depth limit of %d exceeded", v.MaxCallDepth)
+			if !v.handleError(err, depth) {
+				return err
+			}
+			continue
+		}
+		top := len(v.CallStack) - 1
+		f := &v.CallStack[top]
+		for f.Ip < len(v.ops) {
+			if v.MaxSteps > 0 {
+				// Every later step fails too, so catching this can't extend the budget.
+				if v.steps++; v.steps > v.MaxSteps {
+					return fmt.Errorf("step limit of %d exceeded", v.MaxSteps)
+				}
+			}
+			op := v.ops[f.Ip]
 			f.Ip++
 			if err := op(v, f); err != nil {
 				if err.Error() == "_HALT_" {
 					return nil
 				}
-				return err
+				if !v.handleError(err, depth) {
+					return err
+				}
+				break
 			}
-			if len(v.CallStack) != currentStackDepth {
+			if len(v.CallStack) != top+1 || &v.CallStack[top] != f {
 				break
 			}
 		}
+		if len(v.CallStack) == top+1 && f.Ip >= len(v.ops) {
+			return nil
+		}
 	}
 	return nil
 }
 
-func (v *VM) push(val interface{}) {
+func (v *VM) Run(file string) error {
+	if file != "" {
+		if err := v.loadBytecode(file); err != nil {
+			return err
+		}
+	}
+	v.resolveCalls(0, len(v.Instructions), true)
+	v.ops = v.precompile()
+	builtins.Call = v.CallFunction
+	v.CallStack = []Frame{{Instructions: v.Instructions, Ip: 0, Sp: 0}}
+	v.Handlers = v.Handlers[:0]
+	return v.execute(0)
+}
+
+func (v *VM) push(val Value) {
 	if v.Sp >= len(v.Stack) {
-		newStack := make([]interface{}, len(v.Stack)+(len(v.Stack)>>1))
-		copy(newStack, v.Stack)
-		v.Stack = newStack
+		v.grow(v.Sp + 1)
 	}
 	v.Stack[v.Sp] = val
 	v.Sp++
 }
 
-func (v *VM) pop() interface{} {
+// grow makes the stack hold at least n values.
+func (v *VM) grow(n int) {
+	size := len(v.Stack) + (len(v.Stack) >> 1)
+	if size < n {
+		size = n
+	}
+	newStack := make([]Value, size)
+	copy(newStack, v.Stack)
+	v.Stack = newStack
+}
+
+func (v *VM) pop() Value {
 	if v.Sp <= 0 {
 		panic("Stack Underflow")
 	}
 	v.Sp--
 	return v.Stack[v.Sp]
 }
+
+// popCount pops the argument count the compiler pushes before a call.
+func (v *VM) popCount() int {
+	n, _ := v.pop().Num()
+	return int(n)
+}